@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag value for sizes such as "500MB" or "2GiB"
+type byteSize int64
+
+// Size suffixes, longest first so "MiB" is not read as "B"
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseByteSize parses a byte count with an optional decimal (KB, MB, GB,
+// TB) or binary (KiB, MiB, GiB, TiB, K, M, G, T) unit
+func parseByteSize(s string) (byteSize, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	number := s
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			mult = u.size
+			number = strings.TrimSpace(s[:len(s)-len(u.suffix)])
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	// Negated so NaN is rejected too
+	if err != nil || !(n >= 0) || math.IsInf(n, 1) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which no int64 holds
+	size := n * float64(mult)
+	if size >= float64(math.MaxInt64) {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return byteSize(size), nil
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// byteSizeFlag defines a size flag, like flag.Int does for integers
+func byteSizeFlag(name string, value byteSize, usage string) *byteSize {
+	b := value
+	flag.Var(&b, name, usage)
+	return &b
+}
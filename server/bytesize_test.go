@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "1024", want: 1024},
+		{in: "512B", want: 512},
+		{in: "1KB", want: 1000},
+		{in: "1KiB", want: 1024},
+		{in: "1K", want: 1024},
+		{in: "1kb", want: 1000},
+		{in: "1kib", want: 1024},
+		{in: "1.5MB", want: 1500000},
+		{in: "1.5MiB", want: 1572864},
+		{in: " 20 GB ", want: 20000000000},
+		{in: "2GiB", want: 2 << 30},
+		{in: "1TB", want: 1e12},
+		{in: "1TiB", want: 1 << 40},
+		{in: "8000000TiB", want: 8000000 << 40},
+		{in: "", wantErr: true},
+		{in: "MB", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "-1GB", wantErr: true},
+		{in: "NaN", wantErr: true},
+		{in: "NaNGB", wantErr: true},
+		{in: "Inf", wantErr: true},
+		{in: "+InfKB", wantErr: true},
+		{in: "1e300", wantErr: true},
+		{in: "9223372036854775807", wantErr: true},
+		{in: "9000000TiB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseByteSize(%q) = %d, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseByteSize(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"time"
+)
+
+// captureSettings controls the still capture loop
+type captureSettings struct {
+	interval    time.Duration // initial interval between captures
+	minInterval time.Duration // interval used while the screen is changing
+	maxInterval time.Duration // interval the loop backs off to on a static screen
+	threshold   float64       // minimum change score for a frame to be stored
+}
+
+// nextInterval speeds up to the minimum interval after a changed frame and
+// doubles the interval, up to the maximum, while the screen is static
+func (s captureSettings) nextInterval(current time.Duration, changed bool) time.Duration {
+	if changed {
+		return s.minInterval
+	}
+	next := current * 2
+	if next > s.maxInterval {
+		next = s.maxInterval
+	}
+	return next
+}
+
+// captureLoop periodically grabs frames and publishes them for streaming
+type captureLoop struct {
+	cache       *ImageCache
+	broadcaster *SSEBroadcaster
+	source      FrameSource
+	settings    captureSettings
+	encoding    imageEncoding
+	outputs     *outputTracker
+	targets     *targetState
+	windows     windowLocator // nil when windows cannot be located
+	cropTarget  bool          // whether frames show the whole desktop and need cropping to the target
+	redactor    *redactor     // nil when nothing is redacted
+	segments    *segmentTracker
+	locks       *lockWatcher // nil when the lock state is not watched
+
+	// Signature of the last stored frame per output
+	signatures map[string]frameSignature
+}
+
+func (l *captureLoop) run() {
+	l.signatures = make(map[string]frameSignature)
+
+	interval := l.settings.interval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for range timer.C {
+		// Nothing is captured while the session is locked
+		if l.locks.isLocked() {
+			timer.Reset(interval)
+			continue
+		}
+
+		changed, err := l.captureFrame()
+		if err != nil {
+			log.Printf("Failed to capture frame: %v", err)
+		} else {
+			next := l.settings.nextInterval(interval, changed)
+			if next != interval && l.settings.minInterval != l.settings.maxInterval {
+				log.Printf("Capture interval now %s", next)
+			}
+			interval = next
+		}
+		timer.Reset(interval)
+	}
+}
+
+// captureFrame grabs one frame of the capture target and publishes it,
+// along with a crop for each streamed output when the whole screen is
+// captured. It reports whether any image was stored.
+func (l *captureLoop) captureFrame() (bool, error) {
+	// Grab the current screen contents
+	captured := time.Now()
+	img, err := l.source.Grab(context.Background())
+	if err != nil {
+		return false, fmt.Errorf("grab frame: %w", err)
+	}
+	meta := l.frameMeta(captured)
+
+	target := l.targets.get()
+	if l.outputs.enabled() || l.redactor != nil || (l.cropTarget && target.Mode != targetScreen) {
+		if err := l.outputs.refresh(); err != nil {
+			log.Printf("Failed to enumerate outputs: %v", err)
+		}
+	}
+	desktop := l.outputs.desktopBounds()
+	if desktop.Empty() {
+		// Without a monitor layout, assume frame pixels are desktop pixels
+		desktop = img.Bounds()
+	}
+
+	// Redact before anything is cropped, stored or served
+	img, err = l.redact(img, target, desktop)
+	if err != nil {
+		return false, fmt.Errorf("redact frame: %w", err)
+	}
+
+	full := img
+	if l.cropTarget {
+		r, ok, err := target.resolve(l.windows)
+		if err != nil {
+			// Never fall back to the whole screen when a part was asked for
+			return false, fmt.Errorf("locate %s: %w", target, err)
+		}
+		if ok {
+			img, err = cropToDesktopRect(img, r, desktop)
+			if err != nil {
+				return false, fmt.Errorf("crop to %s: %w", target, err)
+			}
+		}
+	}
+
+	changed, err := l.publishFrame(img, meta)
+	if err != nil {
+		return false, err
+	}
+
+	// Per-monitor streams would show more than the chosen region or window
+	if !l.outputs.enabled() || target.Mode != targetScreen {
+		return changed, nil
+	}
+	for _, output := range l.outputs.streamed() {
+		crop, err := cropToDesktopRect(full, output.bounds(), desktop)
+		if err != nil {
+			log.Printf("Failed to capture output %s: %v", output.Name, err)
+			continue
+		}
+		outputMeta := meta
+		outputMeta.Output = output.Name
+		outputChanged, err := l.publishFrame(crop, outputMeta)
+		if err != nil {
+			log.Printf("Failed to capture output %s: %v", output.Name, err)
+			continue
+		}
+		changed = changed || outputChanged
+	}
+	return changed, nil
+}
+
+// frameMeta describes a frame grabbed at the given time
+func (l *captureLoop) frameMeta(captured time.Time) imageMeta {
+	meta := imageMeta{Captured: captured.UTC()}
+	if segment, offset, ok := l.segments.at(captured); ok {
+		meta.Segment = segment
+		meta.Offset = offset.Seconds()
+	}
+	if l.windows != nil {
+		if title, err := l.windows.ActiveWindow(); err == nil && !l.redactor.hidesTitle(title) {
+			meta.Window = title
+		}
+	}
+	return meta
+}
+
+// redact applies the redaction rules to a grabbed frame. Frames from
+// recordings of a region or window show only that part of the desktop.
+func (l *captureLoop) redact(img image.Image, target captureTarget, desktop image.Rectangle) (image.Image, error) {
+	if l.redactor == nil {
+		return img, nil
+	}
+	area := desktop
+	if !l.cropTarget {
+		r, ok, err := target.resolve(l.windows)
+		if err != nil {
+			return nil, fmt.Errorf("locate %s: %w", target, err)
+		}
+		if ok {
+			area = r
+		}
+	}
+	return l.redactor.apply(img, area)
+}
+
+// publishFrame stores and broadcasts a frame if it differs enough from the
+// last frame stored for the same output, reporting whether it was stored
+func (l *captureLoop) publishFrame(img image.Image, meta imageMeta) (bool, error) {
+	output := meta.Output
+
+	// Skip frames that do not differ meaningfully from the last one stored
+	signature := newFrameSignature(img)
+	change := signature.changeScore(l.signatures[output])
+	if threshold := l.settings.threshold; threshold >= 0 && change <= threshold {
+		return false, nil
+	}
+
+	img = fitImage(img, l.encoding.maxDimension)
+	data, err := l.encoding.format.encode(img, l.encoding.quality)
+	if err != nil {
+		return false, fmt.Errorf("encode frame: %w", err)
+	}
+
+	// Add to cache
+	meta.Width, meta.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	filename, err := l.cache.addImage(data, l.encoding.format.ext, meta)
+	if err != nil {
+		return false, fmt.Errorf("save screenshot: %w", err)
+	}
+
+	l.signatures[output] = signature
+
+	// Broadcast to SSE clients
+	imageURL := fmt.Sprintf("/images/%s", filename)
+	l.broadcaster.broadcast(imageEvent{URL: imageURL, Output: output, Change: change})
+	if output == "" {
+		log.Printf("Captured and broadcast image: %s (change %.1f%%)", filename, change*100)
+	} else {
+		log.Printf("Captured and broadcast image for %s: %s (change %.1f%%)", output, filename, change*100)
+	}
+	return true, nil
+}
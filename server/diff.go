@@ -0,0 +1,47 @@
+package main
+
+import (
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// Frames are compared on a grid of this many cells per side
+	signatureGrid = 32
+
+	// Mean luma difference at which a grid cell counts as changed; this
+	// absorbs compression noise between otherwise identical frames
+	signatureTolerance = 6
+)
+
+// frameSignature is a coarse grayscale thumbnail of a frame used to
+// measure how much of the screen changed between captures
+type frameSignature []uint8
+
+// newFrameSignature downscales a frame to a signatureGrid x signatureGrid
+// grayscale grid
+func newFrameSignature(img image.Image) frameSignature {
+	gray := image.NewGray(image.Rect(0, 0, signatureGrid, signatureGrid))
+	draw.ApproxBiLinear.Scale(gray, gray.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return frameSignature(gray.Pix)
+}
+
+// changeScore returns the fraction of grid cells (0-1) that differ between
+// two signatures. A missing previous signature counts as a full change.
+func (s frameSignature) changeScore(prev frameSignature) float64 {
+	if len(prev) != len(s) {
+		return 1
+	}
+	changed := 0
+	for i := range s {
+		d := int(s[i]) - int(prev[i])
+		if d < 0 {
+			d = -d
+		}
+		if d > signatureTolerance {
+			changed++
+		}
+	}
+	return float64(changed) / float64(len(s))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// How long an external encoder may take for one image
+const ffmpegImageTimeout = 30 * time.Second
+
+// imageFormat is an encoding images can be stored and served in
+type imageFormat struct {
+	name        string
+	ext         string
+	contentType string
+	external    bool // needs ffmpeg
+	encode      func(img image.Image, quality int) ([]byte, error)
+	decode      func(data []byte) (image.Image, error)
+}
+
+// imageFormats maps the -image-format and ?format= values to their formats.
+// Go has no WebP or AVIF encoders, so those go through ffmpeg.
+var imageFormats = map[string]*imageFormat{
+	"jpeg": {name: "jpeg", ext: ".jpg", contentType: "image/jpeg", encode: encodeJPEG, decode: decodeWith(jpeg.Decode)},
+	"png":  {name: "png", ext: ".png", contentType: "image/png", encode: encodePNG, decode: decodeWith(png.Decode)},
+	"webp": {name: "webp", ext: ".webp", contentType: "image/webp", external: true, encode: encodeWebP, decode: decodeWith(webp.Decode)},
+	"avif": {name: "avif", ext: ".avif", contentType: "image/avif", external: true, encode: encodeAVIF, decode: decodeAVIF},
+}
+
+// imageFormatNames returns the registered format names in sorted order
+func imageFormatNames() []string {
+	names := make([]string, 0, len(imageFormats))
+	for name := range imageFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupImageFormat returns the format registered under a name, failing if
+// it needs ffmpeg and ffmpeg is not installed
+func lookupImageFormat(name string) (*imageFormat, error) {
+	f, ok := imageFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown image format %q (available: %s)",
+			name, strings.Join(imageFormatNames(), ", "))
+	}
+	if !f.available() {
+		return nil, fmt.Errorf("image format %s requires ffmpeg", name)
+	}
+	return f, nil
+}
+
+// formatByExt returns the format stored under a file extension
+func formatByExt(ext string) *imageFormat {
+	for _, f := range imageFormats {
+		if f.ext == ext {
+			return f
+		}
+	}
+	return nil
+}
+
+// available reports whether images can be encoded in the format here
+func (f *imageFormat) available() bool {
+	if !f.external {
+		return true
+	}
+	_, err := exec.LookPath("ffmpeg")
+	return err == nil
+}
+
+// imageEncoding is how captured frames are written to the image cache
+type imageEncoding struct {
+	format       *imageFormat
+	quality      int // 1-100
+	maxDimension int // longest side in pixels, 0 for no limit
+}
+
+// fitImage scales an image down so its longest side is at most max pixels
+func fitImage(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	if max <= 0 || (b.Dx() <= max && b.Dy() <= max) {
+		return img
+	}
+	w, h := max, b.Dy()*max/b.Dx()
+	if b.Dy() > b.Dx() {
+		w, h = b.Dx()*max/b.Dy(), max
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// resizeToWidth scales an image to the given width, keeping its aspect
+// ratio. Images are never scaled up.
+func resizeToWidth(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if width >= b.Dx() {
+		return img
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// negotiateFormat picks the format to serve an image in from a client's
+// Accept header. The stored format wins whenever the client accepts it as
+// readily as anything else, so browsers are not sent costly conversions.
+func negotiateFormat(accept string, stored *imageFormat) *imageFormat {
+	if strings.TrimSpace(accept) == "" {
+		return stored
+	}
+
+	// Quality values by media range
+	ranges := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges[mediaType] = q
+	}
+	quality := func(f *imageFormat) float64 {
+		for _, r := range []string{f.contentType, "image/*", "*/*"} {
+			if q, ok := ranges[r]; ok {
+				return q
+			}
+		}
+		return 0
+	}
+
+	best, bestQ := stored, quality(stored)
+	for _, name := range imageFormatNames() {
+		f := imageFormats[name]
+		if q := quality(f); q > bestQ && f.available() {
+			best, bestQ = f, q
+		}
+	}
+	return best
+}
+
+// decodeWith adapts a reader-based decoder to in-memory images
+func decodeWith(decode func(r io.Reader) (image.Image, error)) func([]byte) (image.Image, error) {
+	return func(data []byte) (image.Image, error) {
+		return decode(bytes.NewReader(data))
+	}
+}
+
+// encodeJPEG encodes a frame as JPEG
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodePNG encodes a frame as PNG; quality only trades size for speed
+func encodePNG(img image.Image, quality int) ([]byte, error) {
+	enc := png.Encoder{CompressionLevel: png.DefaultCompression}
+	if quality < 50 {
+		enc.CompressionLevel = png.BestSpeed
+	}
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeWebP encodes a frame as lossy WebP with ffmpeg's libwebp encoder
+func encodeWebP(img image.Image, quality int) ([]byte, error) {
+	return ffmpegEncode(img, ".webp", "-c:v", "libwebp", "-quality", strconv.Itoa(quality))
+}
+
+// encodeAVIF encodes a frame as AVIF with ffmpeg's libaom encoder, mapping
+// quality 1-100 onto CRF 63-0
+func encodeAVIF(img image.Image, quality int) ([]byte, error) {
+	crf := 63 - quality*63/100
+	return ffmpegEncode(img, ".avif", "-c:v", "libaom-av1", "-still-picture", "1", "-crf", strconv.Itoa(crf))
+}
+
+// decodeAVIF decodes an AVIF image through ffmpeg, which Go cannot do itself
+func decodeAVIF(data []byte) (image.Image, error) {
+	out, err := ffmpegConvert(data, ".avif", ".png", "-c:v", "png")
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(out))
+}
+
+// ffmpegEncode hands a frame to ffmpeg as PNG and returns it encoded into
+// the container for the given extension
+func ffmpegEncode(img image.Image, ext string, codec ...string) ([]byte, error) {
+	var in bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&in, img); err != nil {
+		return nil, err
+	}
+	return ffmpegConvert(in.Bytes(), ".png", ext, codec...)
+}
+
+// ffmpegConvert converts a single image between formats. It goes through
+// temporary files because the AVIF (ISOBMFF) muxer and demuxer need to seek.
+func ffmpegConvert(data []byte, inExt, outExt string, codec ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegImageTimeout)
+	defer cancel()
+
+	// Unique names, as conversions run concurrently
+	in, err := os.CreateTemp("", "snoopy-convert-*-in"+inExt)
+	if err != nil {
+		return nil, err
+	}
+	inFile := in.Name()
+	defer os.Remove(inFile)
+	_, err = in.Write(data)
+	if closeErr := in.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.CreateTemp("", "snoopy-convert-*-out"+outExt)
+	if err != nil {
+		return nil, err
+	}
+	outFile := out.Name()
+	out.Close()
+	defer os.Remove(outFile)
+
+	args := []string{"-loglevel", "error", "-i", inFile, "-frames:v", "1"}
+	args = append(args, codec...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args, "-y", outFile)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil, fmt.Errorf("ffmpeg: %w", err)
+	}
+	return os.ReadFile(outFile)
+}
@@ -5,7 +5,7 @@ go 1.21
 require (
 	github.com/godbus/dbus/v5 v5.2.2
 	github.com/google/uuid v1.6.0
+	github.com/jezek/xgb v1.1.1
 	golang.org/x/image v0.23.0
+	golang.org/x/sys v0.27.0
 )
-
-require golang.org/x/sys v0.27.0 // indirect
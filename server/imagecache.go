@@ -0,0 +1,463 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Placeholder images served before the first capture and while the screen
+// is locked
+const (
+	waitingImage = "waiting.jpg"
+	lockedImage  = "locked.jpg"
+)
+
+// Resized and converted copies kept per image; the oldest is dropped when
+// another is made
+const maxDerivatives = 8
+
+// ImageCache manages the image cache directory and provides access to images
+type ImageCache struct {
+	mu           sync.RWMutex
+	dir          string
+	maxImages    int                  // per output
+	images       []cachedImage        // sorted by modification time, oldest first
+	latest       map[string]string    // latest image filename per output
+	placeholders map[string]*[]string // placeholder image filenames and their derivatives
+	converting   map[string]*derivativeCall
+}
+
+// derivativeCall is a derivative being created, shared by every request
+// for it until it is written
+type derivativeCall struct {
+	done chan struct{}
+	path string
+	err  error
+}
+
+// cachedImage is an image file held in the cache, as recorded in the
+// index
+type cachedImage struct {
+	Name string `json:"name"`
+	imageMeta
+	Derivatives []string `json:"derivatives,omitempty"` // resized or converted copies, oldest first
+}
+
+// imageMeta describes a captured image
+type imageMeta struct {
+	Output   string    `json:"output,omitempty"` // empty for the whole desktop
+	Captured time.Time `json:"captured"`
+	Segment  string    `json:"segment,omitempty"`        // segment being recorded at capture time
+	Offset   float64   `json:"segment_offset,omitempty"` // seconds into the segment
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Bytes    int64     `json:"bytes"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Window   string    `json:"window,omitempty"` // title of the active window
+}
+
+// imageVariant describes a resized or converted copy of an image
+type imageVariant struct {
+	format  *imageFormat
+	quality int
+	width   int // 0 keeps the original width
+}
+
+// suffix names a variant's file after its original
+func (v imageVariant) suffix() string {
+	s := fmt.Sprintf("-q%d", v.quality)
+	if v.width > 0 {
+		s += fmt.Sprintf("-w%d", v.width)
+	}
+	return s + v.format.ext
+}
+
+func newImageCache(dir string, maxImages int) (*ImageCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	ic := &ImageCache{
+		dir:          dir,
+		maxImages:    maxImages,
+		images:       []cachedImage{},
+		latest:       make(map[string]string),
+		placeholders: make(map[string]*[]string),
+		converting:   make(map[string]*derivativeCall),
+	}
+
+	// Create placeholder images
+	for name, text := range map[string]string{
+		waitingImage: "Waiting for next screen capture",
+		lockedImage:  "Screen locked",
+	} {
+		if err := ic.createPlaceholder(filepath.Join(dir, name), text); err != nil {
+			return nil, err
+		}
+		ic.placeholders[name] = &[]string{}
+	}
+
+	// Pick up images captured before a restart
+	if err := ic.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	return ic, nil
+}
+
+func (ic *ImageCache) createPlaceholder(path, text string) error {
+	// Create a 800x600 image with text
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+
+	// Fill with dark gray background
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{40, 40, 40, 255}}, image.Point{}, draw.Src)
+
+	// Draw text
+	point := fixed.Point26_6{
+		X: fixed.I(800/2 - len(text)*7/2),
+		Y: fixed.I(600 / 2),
+	}
+
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.RGBA{200, 200, 200, 255}),
+		Face: basicfont.Face7x13,
+		Dot:  point,
+	}
+	d.DrawString(text)
+
+	// Save as JPEG
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return jpeg.Encode(f, img, &jpeg.Options{Quality: 90})
+}
+
+// addImage stores an encoded image under the format's extension along with
+// its metadata, and prunes the oldest images of the same output
+func (ic *ImageCache) addImage(data []byte, ext string, meta imageMeta) (string, error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	// Generate UUID for the image
+	id := uuid.New().String()
+	filename := id + ext
+	path := filepath.Join(ic.dir, filename)
+
+	// Write the image
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+
+	// Add to list
+	sum := sha256.Sum256(data)
+	meta.Bytes = int64(len(data))
+	meta.SHA256 = hex.EncodeToString(sum[:])
+	ic.images = append(ic.images, cachedImage{Name: filename, imageMeta: meta})
+	ic.latest[meta.Output] = filename
+
+	// Prune if necessary
+	ic.prune(meta.Output)
+	ic.saveIndex()
+
+	return filename, nil
+}
+
+// prune removes an output's oldest images beyond maxImages. The caller
+// must hold ic.mu.
+func (ic *ImageCache) prune(output string) {
+	count := 0
+	for _, img := range ic.images {
+		if img.Output == output {
+			count++
+		}
+	}
+	if count <= ic.maxImages {
+		return
+	}
+	toRemove := count - ic.maxImages
+	kept := ic.images[:0]
+	for _, img := range ic.images {
+		if toRemove > 0 && img.Output == output {
+			ic.removeFiles(img)
+			toRemove--
+			continue
+		}
+		kept = append(kept, img)
+	}
+	ic.images = kept
+}
+
+// removeFiles deletes an image and its derivatives from disk
+func (ic *ImageCache) removeFiles(img cachedImage) {
+	// Ignore errors
+	os.Remove(filepath.Join(ic.dir, img.Name))
+	for _, d := range img.Derivatives {
+		os.Remove(filepath.Join(ic.dir, d))
+	}
+}
+
+// getLatest returns the newest image of an output, or the waiting
+// placeholder when none has been captured yet
+func (ic *ImageCache) getLatest(output string) string {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	if latest, ok := ic.latest[output]; ok {
+		return latest
+	}
+	return waitingImage
+}
+
+// lookup returns a cached image by ID
+func (ic *ImageCache) lookup(id string) (cachedImage, bool) {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	for _, img := range ic.images {
+		if imageID(img.Name) == id {
+			return img, true
+		}
+	}
+	return cachedImage{}, false
+}
+
+// errUnknownImage is returned for a history cursor naming an image that is
+// not, or no longer, in the cache
+var errUnknownImage = errors.New("unknown image")
+
+// imageCursor is a position in an output's history, given either as an
+// image ID or a capture time
+type imageCursor struct {
+	id   string
+	time time.Time
+}
+
+func (c imageCursor) set() bool {
+	return c.id != "" || !c.time.IsZero()
+}
+
+// history returns up to limit images of an output, oldest first, captured
+// after and before the given cursors. Without an after cursor the newest
+// matching images are returned. more reports whether further images matched.
+// An after cursor naming an image that was already pruned starts from the
+// oldest image kept, and missed reports that images may have been skipped.
+func (ic *ImageCache) history(output string, after, before imageCursor, limit int) (images []cachedImage, more, missed bool, err error) {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+
+	for _, img := range ic.images {
+		if img.Output == output {
+			images = append(images, img)
+		}
+	}
+
+	// indexOf finds the image a cursor names by ID
+	indexOf := func(id string) (int, error) {
+		for i, img := range images {
+			if imageID(img.Name) == id {
+				return i, nil
+			}
+		}
+		return 0, errUnknownImage
+	}
+
+	start, end := 0, len(images)
+	if after.id != "" {
+		i, err := indexOf(after.id)
+		switch {
+		case err == nil:
+			start = i + 1
+		case isImageID(after.id):
+			// Generated by addImage, so most likely pruned since
+			missed = true
+		default:
+			return nil, false, false, err
+		}
+	} else if !after.time.IsZero() {
+		for start < len(images) && !images[start].Captured.After(after.time) {
+			start++
+		}
+	}
+	if before.id != "" {
+		i, err := indexOf(before.id)
+		if err != nil {
+			return nil, false, false, err
+		}
+		end = i
+	} else if !before.time.IsZero() {
+		for end > 0 && !images[end-1].Captured.Before(before.time) {
+			end--
+		}
+	}
+	if end <= start {
+		return []cachedImage{}, false, missed, nil
+	}
+
+	matched := images[start:end]
+	if len(matched) <= limit {
+		return matched, false, missed, nil
+	}
+	if !after.set() {
+		return matched[len(matched)-limit:], true, missed, nil
+	}
+	return matched[:limit], true, missed, nil
+}
+
+// between returns the images of an output captured between two times,
+// oldest first
+func (ic *ImageCache) between(output string, from, to time.Time) []cachedImage {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	return imagesBetween(ic.images, output, from, to)
+}
+
+// imagesBetween filters images by output and capture time
+func imagesBetween(images []cachedImage, output string, from, to time.Time) []cachedImage {
+	var matched []cachedImage
+	for _, img := range images {
+		if img.Output == output && !img.Captured.Before(from) && !img.Captured.After(to) {
+			matched = append(matched, img)
+		}
+	}
+	return matched
+}
+
+// latestImage returns the newest image of an output
+func (ic *ImageCache) latestImage(output string) (cachedImage, bool) {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	for i := len(ic.images) - 1; i >= 0; i-- {
+		if ic.images[i].Output == output {
+			return ic.images[i], true
+		}
+	}
+	return cachedImage{}, false
+}
+
+// find returns the stored filename of an image ID, whatever its format
+func (ic *ImageCache) find(id string) (string, bool) {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	for _, img := range ic.images {
+		if imageID(img.Name) == id {
+			return img.Name, true
+		}
+	}
+	for name := range ic.placeholders {
+		if id == imageID(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// derivative returns the path of a resized or converted copy of a stored
+// image, creating it on first use. Concurrent requests for the same copy
+// wait for a single conversion.
+func (ic *ImageCache) derivative(filename string, stored *imageFormat, v imageVariant) (string, error) {
+	name := strings.TrimSuffix(filename, filepath.Ext(filename)) + v.suffix()
+	path := filepath.Join(ic.dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	ic.mu.Lock()
+	if call, ok := ic.converting[name]; ok {
+		ic.mu.Unlock()
+		<-call.done
+		return call.path, call.err
+	}
+	call := &derivativeCall{done: make(chan struct{})}
+	ic.converting[name] = call
+	ic.mu.Unlock()
+
+	call.path, call.err = ic.createDerivative(filename, name, stored, v)
+
+	ic.mu.Lock()
+	delete(ic.converting, name)
+	ic.mu.Unlock()
+	close(call.done)
+	return call.path, call.err
+}
+
+// createDerivative encodes a copy of a stored image and records it
+// against the original
+func (ic *ImageCache) createDerivative(filename, name string, stored *imageFormat, v imageVariant) (string, error) {
+	path := filepath.Join(ic.dir, name)
+	data, err := os.ReadFile(filepath.Join(ic.dir, filename))
+	if err != nil {
+		return "", err
+	}
+	img, err := stored.decode(data)
+	if err != nil {
+		return "", fmt.Errorf("decode %s: %w", filename, err)
+	}
+	if v.width > 0 {
+		img = resizeToWidth(img, v.width)
+	}
+	encoded, err := v.format.encode(img, v.quality)
+	if err != nil {
+		return "", fmt.Errorf("encode %s as %s: %w", filename, v.format.name, err)
+	}
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	// The original may have been pruned while the copy was made
+	derivatives := ic.derivativesOf(filename)
+	if derivatives == nil {
+		return "", os.ErrNotExist
+	}
+	if err := os.WriteFile(path, encoded, 0o644); err != nil {
+		return "", err
+	}
+	// Recreated after its file went missing, the copy is already listed
+	for _, existing := range *derivatives {
+		if existing == name {
+			return path, nil
+		}
+	}
+	*derivatives = append(*derivatives, name)
+	if len(*derivatives) > maxDerivatives {
+		os.Remove(filepath.Join(ic.dir, (*derivatives)[0])) // Ignore errors
+		*derivatives = (*derivatives)[1:]
+	}
+	ic.saveIndex()
+	return path, nil
+}
+
+// derivativesOf returns the derivative list of a cached image, or nil if
+// the image is no longer held. The caller must hold ic.mu.
+func (ic *ImageCache) derivativesOf(filename string) *[]string {
+	if derivatives, ok := ic.placeholders[filename]; ok {
+		return derivatives
+	}
+	for i := range ic.images {
+		if ic.images[i].Name == filename {
+			return &ic.images[i].Derivatives
+		}
+	}
+	return nil
+}
+
+func (ic *ImageCache) getImagePath(filename string) string {
+	return filepath.Join(ic.dir, filename)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseImageCursor(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		in   string
+		want imageCursor
+	}{
+		{in: "", want: imageCursor{}},
+		{in: "2024-03-01T12:00:00.0000005Z", want: imageCursor{time: at}},
+		{in: "5f0c6f5e-8d1b-4c39-9a57-0e0f1d6c2b11", want: imageCursor{id: "5f0c6f5e-8d1b-4c39-9a57-0e0f1d6c2b11"}},
+		{in: "2024-03-01", want: imageCursor{id: "2024-03-01"}},
+	}
+	for _, tt := range tests {
+		got := parseImageCursor(tt.in)
+		if got.id != tt.want.id || !got.time.Equal(tt.want.time) {
+			t.Errorf("parseImageCursor(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestImageCacheHistory(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	id := func(output string, i int) string {
+		n := i
+		if output != "" {
+			n += 100
+		}
+		return fmt.Sprintf("00000000-0000-4000-8000-%012d", n)
+	}
+
+	// Five desktop images a second apart, interleaved with two of a monitor
+	ic := &ImageCache{}
+	for i := 0; i < 5; i++ {
+		img := cachedImage{Name: id("", i) + ".jpg"}
+		img.Captured = start.Add(time.Duration(i) * time.Second)
+		ic.images = append(ic.images, img)
+		if i < 2 {
+			img := cachedImage{Name: id("HDMI-1", i) + ".jpg"}
+			img.Output = "HDMI-1"
+			img.Captured = start.Add(time.Duration(i)*time.Second + time.Millisecond)
+			ic.images = append(ic.images, img)
+		}
+	}
+
+	pruned := "00000000-0000-4000-8000-999999999999"
+	tests := []struct {
+		name       string
+		output     string
+		after      imageCursor
+		before     imageCursor
+		limit      int
+		want       []int // indexes of the expected images of the output
+		wantMore   bool
+		wantMissed bool
+		wantErr    error
+	}{
+		{name: "all", limit: 10, want: []int{0, 1, 2, 3, 4}},
+		{name: "newest page", limit: 2, want: []int{3, 4}, wantMore: true},
+		{name: "after id", after: imageCursor{id: id("", 1)}, limit: 10, want: []int{2, 3, 4}},
+		{name: "after id paged", after: imageCursor{id: id("", 1)}, limit: 2, want: []int{2, 3}, wantMore: true},
+		{name: "after newest", after: imageCursor{id: id("", 4)}, limit: 10, want: []int{}},
+		{name: "before id", before: imageCursor{id: id("", 3)}, limit: 10, want: []int{0, 1, 2}},
+		{name: "before id paged", before: imageCursor{id: id("", 3)}, limit: 2, want: []int{1, 2}, wantMore: true},
+		{name: "between ids", after: imageCursor{id: id("", 0)}, before: imageCursor{id: id("", 3)}, limit: 10, want: []int{1, 2}},
+		{name: "after time", after: imageCursor{time: start.Add(1500 * time.Millisecond)}, limit: 10, want: []int{2, 3, 4}},
+		{name: "after exact time", after: imageCursor{time: start.Add(2 * time.Second)}, limit: 10, want: []int{3, 4}},
+		{name: "before time", before: imageCursor{time: start.Add(2 * time.Second)}, limit: 10, want: []int{0, 1}},
+		{name: "after pruned id", after: imageCursor{id: pruned}, limit: 10, want: []int{0, 1, 2, 3, 4}, wantMissed: true},
+		{name: "after pruned id paged", after: imageCursor{id: pruned}, limit: 2, want: []int{0, 1}, wantMore: true, wantMissed: true},
+		{name: "after other output", after: imageCursor{id: id("HDMI-1", 0)}, limit: 10, want: []int{0, 1, 2, 3, 4}, wantMissed: true},
+		{name: "monitor", output: "HDMI-1", limit: 10, want: []int{0, 1}},
+		{name: "monitor after id", output: "HDMI-1", after: imageCursor{id: id("HDMI-1", 0)}, limit: 10, want: []int{1}},
+		{name: "unknown output", output: "DP-2", limit: 10, want: []int{}},
+		{name: "after bad id", after: imageCursor{id: "latest"}, limit: 10, wantErr: errUnknownImage},
+		{name: "before pruned id", before: imageCursor{id: pruned}, limit: 10, wantErr: errUnknownImage},
+	}
+	for _, tt := range tests {
+		images, more, missed, err := ic.history(tt.output, tt.after, tt.before, tt.limit)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		var got []string
+		for _, img := range images {
+			got = append(got, img.Name)
+		}
+		var want []string
+		for _, i := range tt.want {
+			want = append(want, id(tt.output, i)+".jpg")
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) || more != tt.wantMore || missed != tt.wantMissed {
+			t.Errorf("%s: got %v more=%v missed=%v, want %v more=%v missed=%v", tt.name, got, more, missed, want, tt.wantMore, tt.wantMissed)
+		}
+	}
+}
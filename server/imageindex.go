@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// imageIndexFile is the cache's on-disk manifest
+const imageIndexFile = "index.json"
+
+// imageIndex is the manifest listing cached images in capture order
+type imageIndex struct {
+	Images []cachedImage `json:"images"`
+}
+
+// loadIndex rebuilds the image list after a restart from the manifest and
+// the files in the cache directory. Image files missing from the manifest
+// are adopted, derivatives and leftovers of images no longer held are
+// removed, and maxImages is enforced again.
+func (ic *ImageCache) loadIndex() error {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	entries, err := os.ReadDir(ic.dir)
+	if err != nil {
+		return fmt.Errorf("read image cache: %w", err)
+	}
+	modTimes := make(map[string]time.Time)
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		modTimes[e.Name()] = info.ModTime()
+	}
+
+	var index imageIndex
+	data, err := os.ReadFile(filepath.Join(ic.dir, imageIndexFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			log.Printf("Image index is damaged, rebuilding from files: %v", err)
+			index = imageIndex{}
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("read image index: %w", err)
+	}
+
+	// Keep manifest entries whose files survived
+	seen := make(map[string]bool)
+	var images []cachedImage
+	for _, img := range index.Images {
+		if _, ok := modTimes[img.Name]; !ok || seen[imageID(img.Name)] {
+			continue
+		}
+		img.Derivatives = nil
+		images = append(images, img)
+		seen[imageID(img.Name)] = true
+	}
+
+	// Adopt captured images the manifest does not know about, such as
+	// those written just before a crash
+	for name := range modTimes {
+		if id := imageID(name); !seen[id] && isImageID(id) && formatByExt(filepath.Ext(name)) != nil {
+			images = append(images, ic.adoptImage(name, modTimes[name]))
+			seen[id] = true
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return modTimes[images[i].Name].Before(modTimes[images[j].Name])
+	})
+	byID := make(map[string]*cachedImage)
+	for i := range images {
+		byID[imageID(images[i].Name)] = &images[i]
+	}
+
+	// Attach derivatives to their originals and remove everything else
+	removed := 0
+	for name := range modTimes {
+		if name == imageIndexFile || ic.placeholders[name] != nil {
+			continue
+		}
+		if img := byID[imageID(name)]; img != nil && img.Name == name {
+			continue
+		}
+		if len(name) > 36 && name[36] == '-' {
+			if img := byID[name[:36]]; img != nil {
+				img.Derivatives = append(img.Derivatives, name)
+				continue
+			}
+		}
+		os.Remove(filepath.Join(ic.dir, name)) // Ignore errors
+		removed++
+	}
+	for i := range images {
+		sort.Slice(images[i].Derivatives, func(a, b int) bool {
+			d := images[i].Derivatives
+			return modTimes[d[a]].Before(modTimes[d[b]])
+		})
+	}
+
+	ic.images = images
+	outputs := make(map[string]bool)
+	for _, img := range ic.images {
+		outputs[img.Output] = true
+	}
+	for output := range outputs {
+		ic.prune(output)
+	}
+	for _, img := range ic.images {
+		ic.latest[img.Output] = img.Name
+	}
+	ic.saveIndex()
+
+	if len(ic.images) > 0 || removed > 0 {
+		log.Printf("Image cache: restored %d images, removed %d orphaned files", len(ic.images), removed)
+	}
+	return nil
+}
+
+// adoptImage recovers what metadata it can from an image file the manifest
+// does not list
+func (ic *ImageCache) adoptImage(name string, modTime time.Time) cachedImage {
+	img := cachedImage{Name: name, imageMeta: imageMeta{Captured: modTime}}
+	data, err := os.ReadFile(filepath.Join(ic.dir, name))
+	if err != nil {
+		return img
+	}
+	sum := sha256.Sum256(data)
+	img.Bytes = int64(len(data))
+	img.SHA256 = hex.EncodeToString(sum[:])
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		img.Width, img.Height = cfg.Width, cfg.Height
+	}
+	return img
+}
+
+// readImageIndex reads the manifest of a cache directory without loading
+// the cache, for tools running beside the server
+func readImageIndex(dir string) ([]cachedImage, error) {
+	data, err := os.ReadFile(filepath.Join(dir, imageIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("read image index: %w", err)
+	}
+	var index imageIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("read image index: %w", err)
+	}
+	return index.Images, nil
+}
+
+// saveIndex writes the manifest. The caller must hold ic.mu.
+func (ic *ImageCache) saveIndex() {
+	data, err := json.Marshal(imageIndex{Images: ic.images})
+	if err != nil {
+		log.Printf("Failed to encode image index: %v", err)
+		return
+	}
+	// Replace the manifest atomically so a crash never leaves it truncated
+	path := filepath.Join(ic.dir, imageIndexFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("Failed to write image index: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Failed to write image index: %v", err)
+	}
+}
+
+// imageID strips the extension from a cached image filename
+func imageID(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// isImageID reports whether a name is an image ID generated by addImage
+func isImageID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil && len(id) == 36
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// segmentJournalFile is the segment journal in the output directory, one
+// JSON entry per line
+const segmentJournalFile = "journal.jsonl"
+
+// Journal entries older than this are dropped on startup
+const journalMaxAge = 30 * 24 * time.Hour
+
+// Journal events
+const (
+	journalRequested = "requested" // a segment start was asked for
+	journalStarted   = "started"   // the backend confirmed the segment
+	journalFailed    = "failed"    // the backend could not start the segment
+	journalStopped   = "stopped"   // a segment ended
+	journalGap       = "gap"       // nothing was recorded between since and time
+	journalChecked   = "checked"   // a segment left by an earlier run was found complete
+	journalRepaired  = "repaired"  // an incomplete segment was remuxed
+	journalDamaged   = "damaged"   // a segment is incomplete and could not be repaired
+)
+
+// Recording coverage metrics, served at /debug/vars
+var (
+	segmentStartFailures = expvar.NewInt("segment_start_failures")
+	recordingGapSeconds  = expvar.NewFloat("recording_gap_seconds")
+)
+
+// journalEntry is one line of the segment journal
+type journalEntry struct {
+	Time    time.Time  `json:"time"`
+	Event   string     `json:"event"`
+	Segment string     `json:"segment,omitempty"`
+	Target  string     `json:"target,omitempty"`
+	Latency float64    `json:"latency,omitempty"` // seconds from request to confirmation
+	Since   *time.Time `json:"since,omitempty"`   // start of a gap
+	Reason  string     `json:"reason,omitempty"`  // why a segment stopped, a gap began or a segment was repaired
+	Error   string     `json:"error,omitempty"`
+}
+
+// segmentJournal records when each segment was requested, confirmed and
+// stopped, and the gaps in coverage between segments, so they can be
+// queried independently of the backend's file naming
+type segmentJournal struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries []journalEntry
+
+	requestedAt time.Time // of the pending start
+	active      []string  // segments being recorded, oldest first
+	idleSince   time.Time // when the last segment stopped, zero while recording
+	idleReason  string
+}
+
+// openJournal loads the journal in dir and opens it for appending. A
+// segment left running by the previous process is taken to have ended
+// when its file was last written.
+func openJournal(dir string) (*segmentJournal, error) {
+	path := filepath.Join(dir, segmentJournalFile)
+	j := &segmentJournal{}
+
+	entries, trimmed, err := readJournal(path, time.Now().Add(-journalMaxAge))
+	if err != nil {
+		return nil, err
+	}
+	j.entries = entries
+	if trimmed {
+		if err := writeJournal(path, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	// Work out how the previous run ended
+	var running []string
+	for _, e := range entries {
+		switch e.Event {
+		case journalStarted:
+			running = append(running, e.Segment)
+		case journalStopped:
+			if len(running) > 0 {
+				running = running[1:]
+			}
+			if len(running) == 0 {
+				j.idleSince, j.idleReason = e.Time, e.Reason
+			}
+		}
+	}
+	if len(running) > 0 {
+		j.idleSince = entries[len(entries)-1].Time
+		for _, name := range running {
+			if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.ModTime().After(j.idleSince) {
+				j.idleSince = info.ModTime()
+			}
+		}
+		j.idleReason = "snoopy exited while recording"
+	}
+
+	j.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open segment journal: %w", err)
+	}
+	return j, nil
+}
+
+// readJournal reads the entries newer than cutoff, skipping damaged lines,
+// and reports whether any were dropped
+func readJournal(path string, cutoff time.Time) ([]journalEntry, bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("read segment journal: %w", err)
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	trimmed := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Most likely a line cut short when the process died
+			log.Printf("Skipping damaged segment journal entry: %v", err)
+			trimmed = true
+			continue
+		}
+		if e.Time.Before(cutoff) {
+			trimmed = true
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, fmt.Errorf("read segment journal: %w", err)
+	}
+	return entries, trimmed, nil
+}
+
+// writeJournal replaces the journal atomically
+func writeJournal(path string, entries []journalEntry) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("write segment journal: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("write segment journal: %w", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write segment journal: %w", err)
+	}
+	return nil
+}
+
+// record appends an entry. The caller must hold j.mu.
+func (j *segmentJournal) record(e journalEntry) {
+	j.entries = append(j.entries, e)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write segment journal: %v", err)
+	}
+}
+
+// requested notes that a segment start is being asked for
+func (j *segmentJournal) requested(segment, target string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.requestedAt = time.Now()
+	j.record(journalEntry{Time: j.requestedAt, Event: journalRequested, Segment: segment, Target: target})
+}
+
+// started notes that the backend confirmed the segment, closing any gap
+// in coverage
+func (j *segmentJournal) started(segment string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	if len(j.active) == 0 && !j.idleSince.IsZero() {
+		since := j.idleSince
+		gap := now.Sub(since)
+		j.record(journalEntry{Time: now, Event: journalGap, Since: &since, Reason: j.idleReason})
+		recordingGapSeconds.Add(gap.Seconds())
+		log.Printf("Recording gap of %s (%s)", gap.Round(time.Second), j.idleReason)
+	}
+	j.idleSince, j.idleReason = time.Time{}, ""
+
+	var latency float64
+	if !j.requestedAt.IsZero() {
+		latency = now.Sub(j.requestedAt).Seconds()
+	}
+	j.record(journalEntry{Time: now, Event: journalStarted, Segment: segment, Latency: latency})
+	j.active = append(j.active, segment)
+}
+
+// failed notes that the backend could not start a segment
+func (j *segmentJournal) failed(segment string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	segmentStartFailures.Add(1)
+	j.record(journalEntry{Time: time.Now(), Event: journalFailed, Segment: segment, Error: err.Error()})
+	if len(j.active) == 0 && j.idleSince.IsZero() {
+		// Nothing was recorded from the start
+		j.idleSince, j.idleReason = j.requestedAt, "start failed"
+	}
+}
+
+// stopped notes that the oldest segment being recorded ended and returns
+// its name. Once no segment is left recording a gap begins.
+func (j *segmentJournal) stopped(reason string, err error) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.active) == 0 {
+		return ""
+	}
+	e := journalEntry{Time: time.Now(), Event: journalStopped, Segment: j.active[0], Reason: reason}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	j.record(e)
+	j.active = j.active[1:]
+	if len(j.active) == 0 {
+		j.idleSince, j.idleReason = e.Time, reason
+	}
+	return e.Segment
+}
+
+// query returns the entries between since and until, either of which may
+// be zero, optionally of one event only
+func (j *segmentJournal) query(since, until time.Time, event string) []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := []journalEntry{}
+	for _, e := range j.entries {
+		if event != "" && e.Event != event {
+			continue
+		}
+		// Gaps overlapping the window are included
+		start := e.Time
+		if e.Since != nil {
+			start = *e.Since
+		}
+		if (!since.IsZero() && e.Time.Before(since)) || (!until.IsZero() && start.After(until)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// span returns when a segment was confirmed and, once it has ended, when
+// it stopped
+func (j *segmentJournal) span(segment string) (start, stop time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range j.entries {
+		if e.Segment != segment {
+			continue
+		}
+		switch e.Event {
+		case journalStarted:
+			start = e.Time
+		case journalStopped:
+			stop = e.Time
+		}
+	}
+	return start, stop
+}
+
+// target returns the capture target a segment was requested with, as
+// described by captureTarget.String, or "" if it is not in the journal
+func (j *segmentJournal) target(segment string) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range j.entries {
+		if e.Segment == segment && e.Event == journalRequested {
+			return e.Target
+		}
+	}
+	return ""
+}
+
+// noteIntegrity records the outcome of checking a segment
+func (j *segmentJournal) noteIntegrity(segment, event, problem string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := journalEntry{Time: time.Now(), Event: event, Segment: segment, Reason: problem}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	j.record(e)
+}
+
+// checked reports whether a segment's integrity was already checked
+func (j *segmentJournal) checked(segment string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range j.entries {
+		if e.Segment == segment && (e.Event == journalChecked || e.Event == journalRepaired || e.Event == journalDamaged) {
+			return true
+		}
+	}
+	return false
+}
+
+// integrity returns the last integrity event recorded for a segment and
+// the problem found, or "" if it was never found incomplete
+func (j *segmentJournal) integrity(segment string) (event, problem string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range j.entries {
+		if e.Segment == segment && (e.Event == journalRepaired || e.Event == journalDamaged) {
+			event, problem = e.Event, e.Reason
+		}
+	}
+	return event, problem
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	logindDest         = "org.freedesktop.login1"
+	logindManagerPath  = "/org/freedesktop/login1"
+	logindManagerIface = "org.freedesktop.login1.Manager"
+	logindSessionIface = "org.freedesktop.login1.Session"
+	logindUserIface    = "org.freedesktop.login1.User"
+)
+
+// watchLogind follows the LockedHint of the user's graphical logind
+// session, which desktops set while the lock screen is shown, and the
+// session's Lock and Unlock signals
+func (w *lockWatcher) watchLogind() error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	path, err := findLogindSession(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	session := conn.Object(logindDest, path)
+	hint, err := session.GetProperty(logindSessionIface + ".LockedHint")
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("read LockedHint: %w", err)
+	}
+
+	matches := [][]dbus.MatchOption{
+		{dbus.WithMatchObjectPath(path), dbus.WithMatchInterface("org.freedesktop.DBus.Properties"), dbus.WithMatchMember("PropertiesChanged")},
+		{dbus.WithMatchObjectPath(path), dbus.WithMatchInterface(logindSessionIface), dbus.WithMatchMember("Lock")},
+		{dbus.WithMatchObjectPath(path), dbus.WithMatchInterface(logindSessionIface), dbus.WithMatchMember("Unlock")},
+	}
+	for _, m := range matches {
+		if err := conn.AddMatchSignal(m...); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	signals := make(chan *dbus.Signal, 8)
+	conn.Signal(signals)
+
+	if locked, ok := hint.Value().(bool); ok {
+		w.update("logind", locked)
+	}
+
+	go func() {
+		for sig := range signals {
+			if sig.Path != path {
+				continue
+			}
+			switch sig.Name {
+			case logindSessionIface + ".Lock":
+				w.update("logind", true)
+			case logindSessionIface + ".Unlock":
+				w.update("logind", false)
+			case "org.freedesktop.DBus.Properties.PropertiesChanged":
+				if len(sig.Body) < 2 {
+					continue
+				}
+				changed, ok := sig.Body[1].(map[string]dbus.Variant)
+				if !ok {
+					continue
+				}
+				if v, ok := changed["LockedHint"]; ok {
+					if locked, ok := v.Value().(bool); ok {
+						w.update("logind", locked)
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// findLogindSession finds the logind session snoopy belongs to or, when
+// it runs as a user service outside any session, the user's display
+// session
+func findLogindSession(conn *dbus.Conn) (dbus.ObjectPath, error) {
+	manager := conn.Object(logindDest, logindManagerPath)
+
+	var path dbus.ObjectPath
+	if err := manager.Call(logindManagerIface+".GetSessionByPID", 0, uint32(os.Getpid())).Store(&path); err == nil {
+		return path, nil
+	}
+	if id := os.Getenv("XDG_SESSION_ID"); id != "" {
+		if err := manager.Call(logindManagerIface+".GetSession", 0, id).Store(&path); err == nil {
+			return path, nil
+		}
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return "", err
+	}
+	var userPath dbus.ObjectPath
+	if err := manager.Call(logindManagerIface+".GetUser", 0, uint32(uid)).Store(&userPath); err != nil {
+		return "", fmt.Errorf("find logind user: %w", err)
+	}
+	display, err := conn.Object(logindDest, userPath).GetProperty(logindUserIface + ".Display")
+	if err != nil {
+		return "", fmt.Errorf("find display session: %w", err)
+	}
+	// Display is a (session id, object path) pair
+	if pair, ok := display.Value().([]interface{}); ok && len(pair) == 2 {
+		if p, ok := pair[1].(dbus.ObjectPath); ok && p != "/" {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("user has no display session")
+}
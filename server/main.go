@@ -1,40 +1,30 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"image"
-	"image/color"
-	"image/draw"
-	"image/jpeg"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/godbus/dbus/v5"
-	"github.com/google/uuid"
-	"golang.org/x/image/font"
-	"golang.org/x/image/font/basicfont"
-	"golang.org/x/image/math/fixed"
 )
 
 const (
-	dest        = "org.gnome.Shell.Screencast"
-	objPath     = "/org/gnome/Shell/Screencast"
-	iface       = "org.gnome.Shell.Screencast"
-	startMethod = iface + ".Screencast"
-	stopMethod  = iface + ".StopScreencast"
-
 	// Avahi constants
 	avahiDest                  = "org.freedesktop.Avahi"
 	avahiServerPath            = "/"
@@ -44,42 +34,60 @@ const (
 	avahiProtoUnspec     int32 = -1
 )
 
-// ImageCache manages the image cache directory and provides access to images
-type ImageCache struct {
-	mu         sync.RWMutex
-	dir        string
-	maxImages  int
-	images     []string // sorted by modification time, oldest first
-	latest     string   // latest image filename
-	waitingImg string   // path to the waiting placeholder image
+// imageEvent announces a newly captured image to SSE clients
+type imageEvent struct {
+	URL    string  `json:"url"`
+	Output string  `json:"output,omitempty"` // empty for the whole desktop
+	Change float64 `json:"change,omitempty"` // fraction of the screen that changed since the previous image
+	State  string  `json:"state,omitempty"`  // "locked" or "unlocked" when the session's lock state changed
 }
 
+// Session states announced to SSE clients
+const (
+	stateLocked   = "locked"
+	stateUnlocked = "unlocked"
+)
+
 // SSEBroadcaster manages SSE clients
 type SSEBroadcaster struct {
 	mu      sync.RWMutex
-	clients map[chan string]bool
+	clients map[chan imageEvent]bool
+	locked  bool // whether new clients are told the session is locked
 }
 
 func newSSEBroadcaster() *SSEBroadcaster {
 	return &SSEBroadcaster{
-		clients: make(map[chan string]bool),
+		clients: make(map[chan imageEvent]bool),
 	}
 }
 
-func (b *SSEBroadcaster) addClient(ch chan string) {
+func (b *SSEBroadcaster) addClient(ch chan imageEvent) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.clients[ch] = true
 }
 
-func (b *SSEBroadcaster) removeClient(ch chan string) {
+func (b *SSEBroadcaster) removeClient(ch chan imageEvent) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	delete(b.clients, ch)
 	close(ch)
 }
 
-func (b *SSEBroadcaster) broadcast(msg string) {
+// setLocked records the session's lock state for clients that connect later
+func (b *SSEBroadcaster) setLocked(locked bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.locked = locked
+}
+
+func (b *SSEBroadcaster) isLocked() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.locked
+}
+
+func (b *SSEBroadcaster) broadcast(msg imageEvent) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	for ch := range b.clients {
@@ -214,7 +222,7 @@ func (as *AvahiService) prepareTXTRecords() [][]byte {
 		"proto=http",
 		"path=/",
 		"sse=/sse/image",
-		"caps=stream,screencast",
+		"caps=stream,screencast,outputs,capture",
 	}
 
 	txtRecords := make([][]byte, len(records))
@@ -267,128 +275,78 @@ func (as *AvahiService) GetServiceName() string {
 	return as.serviceName
 }
 
-func newImageCache(dir string, maxImages int) (*ImageCache, error) {
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return nil, err
-	}
-
-	ic := &ImageCache{
-		dir:       dir,
-		maxImages: maxImages,
-		images:    []string{},
-	}
-
-	// Create waiting placeholder image
-	waitingPath := filepath.Join(dir, "waiting.jpg")
-	if err := ic.createWaitingImage(waitingPath); err != nil {
-		return nil, err
-	}
-	ic.waitingImg = waitingPath
-	ic.latest = "waiting.jpg"
-
-	return ic, nil
-}
-
-func (ic *ImageCache) createWaitingImage(path string) error {
-	// Create a 800x600 image with text
-	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
-
-	// Fill with dark gray background
-	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{40, 40, 40, 255}}, image.Point{}, draw.Src)
-
-	// Draw text
-	text := "Waiting for next screen capture"
-	point := fixed.Point26_6{
-		X: fixed.I(800/2 - len(text)*7/2),
-		Y: fixed.I(600 / 2),
-	}
-
-	d := &font.Drawer{
-		Dst:  img,
-		Src:  image.NewUniform(color.RGBA{200, 200, 200, 255}),
-		Face: basicfont.Face7x13,
-		Dot:  point,
-	}
-	d.DrawString(text)
-
-	// Save as JPEG
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	return jpeg.Encode(f, img, &jpeg.Options{Quality: 90})
-}
-
-func (ic *ImageCache) addImage(data []byte) (string, error) {
-	ic.mu.Lock()
-	defer ic.mu.Unlock()
-
-	// Generate UUID for the image
-	id := uuid.New().String()
-	filename := fmt.Sprintf("%s.jpg", id)
-	path := filepath.Join(ic.dir, filename)
-
-	// Write the image
-	if err := os.WriteFile(path, data, 0o644); err != nil {
-		return "", err
-	}
-
-	// Add to list
-	ic.images = append(ic.images, filename)
-	ic.latest = filename
-
-	// Prune if necessary
-	if len(ic.images) > ic.maxImages {
-		toRemove := len(ic.images) - ic.maxImages
-		for i := 0; i < toRemove; i++ {
-			oldPath := filepath.Join(ic.dir, ic.images[i])
-			os.Remove(oldPath) // Ignore errors
+func main() {
+	// Subcommands work on what the server left on disk
+	if len(os.Args) > 1 && os.Args[1] == "timelapse" {
+		if err := runTimelapseCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Timelapse failed: %v", err)
 		}
-		ic.images = ic.images[toRemove:]
-	}
-
-	return filename, nil
-}
-
-func (ic *ImageCache) getLatest() string {
-	ic.mu.RLock()
-	defer ic.mu.RUnlock()
-	return ic.latest
-}
-
-func (ic *ImageCache) getImagePath(filename string) string {
-	return filepath.Join(ic.dir, filename)
-}
-
-// checkDBusConnection verifies that the DBus connection is still alive
-// by calling the Ping method on the Peer interface
-func checkDBusConnection(conn *dbus.Conn) error {
-	// Use the Peer.Ping method which is available on all DBus connections
-	// This is a standard DBus interface for checking connection health
-	obj := conn.BusObject()
-	call := obj.Call("org.freedesktop.DBus.Peer.Ping", 0)
-	if call.Err != nil {
-		return fmt.Errorf("DBus connection lost: %w", call.Err)
+		return
 	}
-	return nil
-}
 
-func main() {
 	var (
 		outDir           = flag.String("out", "", "Output directory (default: ~/.cache/snoopy/video)")
-		segment          = flag.Duration("segment", 30*time.Minute, "Segment duration")
+		segment          = flag.Duration("segment", 30*time.Minute, "Segment duration (0 disables recording)")
 		pause            = flag.Duration("pause", 1*time.Second, "Pause between segments")
-		template         = flag.String("template", "screen-%d-%t.webm", "Filename template used by GNOME Shell")
+		template         = flag.String("template", "screen-%d-%t.webm", "Segment filename template; %d and %t are replaced by the start date and time")
 		addr             = flag.String("addr", "0.0.0.0", "HTTP server bind address")
 		port             = flag.Int("port", 8900, "HTTP server port")
 		imageInterval    = flag.Duration("image-interval", 5*time.Second, "Interval between screen captures for web streaming")
-		imageCacheSize   = flag.Int("image-cache-size", 100, "Maximum number of images to keep in cache")
+		imageIntervalMin = flag.Duration("image-interval-min", 0, "Shortest capture interval while the screen is changing (default: -image-interval)")
+		imageIntervalMax = flag.Duration("image-interval-max", 0, "Longest capture interval while the screen is static (default: -image-interval)")
+		segmentKeep      = flag.Int("segment-keep", 0, "Number of recorded segments to keep (0 for no limit)")
+		segmentMaxAge    = flag.Duration("segment-max-age", 0, "Remove recorded segments older than this (0 for no limit)")
+		segmentMaxBytes  = byteSizeFlag("segment-max-bytes", 0, "Maximum total `size` of recorded segments, e.g. 20GB (0 for no limit)")
+		remux            = flag.Bool("remux", false, "Write an MP4 copy of each finished segment to -out/processed")
+		transcodeBitrate = flag.String("transcode-bitrate", "", "Re-encode processed segments to H.264 at this bitrate, e.g. 1M (implies -remux)")
+		daily            = flag.Bool("daily", false, "Concatenate processed segments into one MP4 per day (implies -remux)")
+		processedMaxBytes = byteSizeFlag("processed-max-bytes", 0, "Maximum total `size` of post-processed output, e.g. 50GB (0 for no limit); -segment-max-age applies as well")
+		minFree          = byteSizeFlag("min-free", 0, "Pause recording while free disk `space` in -out is below this, e.g. 1GB (0 never pauses)")
+		imageCacheSize   = flag.Int("image-cache-size", 100, "Maximum number of images to keep in cache for each stream (whole desktop and each -outputs monitor)")
+		imageMaxAge      = flag.Duration("image-max-age", 0, "Remove cached images older than this (0 keeps them until -image-cache-size is reached)")
+		imageCacheBytes  = byteSizeFlag("image-cache-bytes", 0, "Maximum total `size` of cached images, e.g. 500MB (0 for no limit)")
+		imageFormatFlag  = flag.String("image-format", "jpeg", "Format captured images are stored in ("+strings.Join(imageFormatNames(), ", ")+")")
+		imageQuality     = flag.Int("image-quality", 90, "Encoding quality (1-100) for stored and converted images")
+		imageMaxDim      = flag.Int("image-max-dimension", 0, "Scale stored images down so their longest side is at most this many pixels (0 keeps full size)")
 		healthCheckInterval = flag.Duration("health-check", 15*time.Second, "Interval for DBus connection health checks")
+		backend          = flag.String("backend", "gnome", "Capture backend ("+strings.Join(recorderBackendNames(), ", ")+")")
+		stills           = flag.String("stills", "video", "Still frame source for web streaming ("+strings.Join(frameSourceNames(), ", ")+")")
+		outputsFlag      = flag.String("outputs", "", "Monitors to stream separately: comma separated output names, or \"all\"")
+		changeThreshold  = flag.Float64("change-threshold", 0, "Fraction of the screen (0-1) that must change for a capture to be stored and broadcast; negative keeps every capture")
+		regionFlag       = flag.String("region", "", "Capture only this desktop region, given as x,y,width,height")
+		windowFlag       = flag.String("window", "", "Capture only the window whose title contains this text")
+		redactFlag       = flag.String("redact", "", "JSON file of regions and windows to hide in streamed images")
 	)
 	flag.Parse()
 
+	// The capture target can be changed later through /api/capture
+	target := captureTarget{Mode: targetScreen}
+	switch {
+	case *regionFlag != "" && *windowFlag != "":
+		log.Fatalf("-region and -window cannot be used together")
+	case *regionFlag != "":
+		region, err := parseRegion(*regionFlag)
+		if err != nil {
+			log.Fatalf("Invalid -region: %v", err)
+		}
+		target = captureTarget{Mode: targetRegion, Region: &region}
+	case *windowFlag != "":
+		target = captureTarget{Mode: targetWindow, Window: *windowFlag}
+	}
+	targets, err := newTargetState(target)
+	if err != nil {
+		log.Fatalf("Invalid capture target: %v", err)
+	}
+
+	// Windows are located through the X server; without one, window
+	// targets can only be recorded by backends that pick windows themselves
+	var windows windowLocator
+	if locator, err := newX11WindowLocator(); err != nil {
+		log.Printf("Window lookup unavailable: %v", err)
+	} else {
+		windows = locator
+	}
+
 	home, err := os.UserHomeDir()
 	if err != nil {
 		log.Fatalf("UserHomeDir: %v", err)
@@ -400,6 +358,32 @@ func main() {
 		log.Fatalf("mkdir %s: %v", *outDir, err)
 	}
 
+	// Capture adapts between the min and max intervals; by default both
+	// equal -image-interval, giving a fixed rate
+	capture := captureSettings{
+		interval:    *imageInterval,
+		minInterval: *imageIntervalMin,
+		maxInterval: *imageIntervalMax,
+		threshold:   *changeThreshold,
+	}
+	if capture.minInterval <= 0 || capture.minInterval > capture.interval {
+		capture.minInterval = capture.interval
+	}
+	if capture.maxInterval <= 0 || capture.maxInterval < capture.interval {
+		capture.maxInterval = capture.interval
+	}
+
+	// Captured frames are encoded once when stored; other formats are
+	// converted per request
+	if *imageQuality < 1 || *imageQuality > 100 {
+		log.Fatalf("-image-quality must be between 1 and 100")
+	}
+	storedFormat, err := lookupImageFormat(*imageFormatFlag)
+	if err != nil {
+		log.Fatalf("Invalid -image-format: %v", err)
+	}
+	encoding := imageEncoding{format: storedFormat, quality: *imageQuality, maxDimension: *imageMaxDim}
+
 	// Setup image cache
 	cacheDir := filepath.Join(home, ".cache", "snoopy", "images")
 	imageCache, err := newImageCache(cacheDir, *imageCacheSize)
@@ -407,6 +391,12 @@ func main() {
 		log.Fatalf("Failed to create image cache: %v", err)
 	}
 
+	// Age and size limits are enforced in the background
+	retention := imageRetention{maxAge: *imageMaxAge, maxBytes: int64(*imageCacheBytes)}
+	if retention.enabled() {
+		go imageCache.runJanitor(retention)
+	}
+
 	// Setup SSE broadcaster
 	broadcaster := newSSEBroadcaster()
 
@@ -417,18 +407,6 @@ func main() {
 	}
 	serviceName := username
 
-	// Start HTTP server
-	go startHTTPServer(*addr, *port, imageCache, broadcaster, serviceName)
-
-	// Start screen capture loop for web streaming
-	// Check if ffmpeg is available
-	if _, err := exec.LookPath("ffmpeg"); err != nil {
-		log.Printf("Warning: ffmpeg not found in PATH - web streaming will show static waiting image")
-		log.Printf("Install ffmpeg to enable live screen streaming feature")
-	} else {
-		go startScreenCaptureLoop(imageCache, broadcaster, *imageInterval, *outDir)
-	}
-
 	// Start Avahi service advertisement
 	avahiService, err := newAvahiService(*port)
 	if err != nil {
@@ -451,22 +429,257 @@ func main() {
 	}
 	defer conn.Close()
 
-	obj := conn.Object(dest, dbus.ObjectPath(objPath))
-	ctx := context.Background()
+	// Recording and capture pause while the session is locked
+	locks, err := newLockWatcher(conn)
+	if err != nil {
+		log.Printf("Lock detection unavailable: %v", err)
+	}
+	var lockChanges <-chan bool
+	if locks != nil {
+		lockChanges = locks.changes
+	}
 
+	// Redaction rules must all be enforceable before anything is streamed
+	var redact *redactor
+	if *redactFlag != "" {
+		redact, err = loadRedactor(*redactFlag, windows, conn)
+		if err != nil {
+			log.Fatalf("Failed to load redaction rules: %v", err)
+		}
+		log.Printf("Redaction rules loaded from %s", *redactFlag)
+	}
+
+	// Start screen capture loop for web streaming
+	frameSource, err := newFrameSource(*stills, stillsConfig{videoDir: *outDir, interval: capture.minInterval, conn: conn})
+	if errors.Is(err, errScreenshotDenied) {
+		log.Fatalf("Stills source %s cannot be used: %v", *stills, err)
+	}
+	if err != nil {
+		log.Printf("Warning: %v - web streaming will show static waiting image", err)
+		if *stills == "video" {
+			log.Printf("Install ffmpeg to enable live screen streaming feature")
+		}
+	}
+
+	// Monitors are enumerated by the stills source when it can, otherwise
+	// through Mutter
+	var lister outputLister = newMutterOutputLister(conn)
+	if sourceLister, ok := frameSource.(outputLister); ok {
+		lister = sourceLister
+	}
+	outputs := newOutputTracker(lister, *outputsFlag)
+
+	// Captured images are traced back to the segment being recorded
+	segments := &segmentTracker{}
+	journal, err := openJournal(*outDir)
+	if err != nil {
+		log.Fatalf("Failed to open segment journal: %v", err)
+	}
+	catalogue := newSegmentCatalogue(*outDir, segments, journal)
+
+	// Finished segments are optionally remuxed, transcoded and concatenated
+	var post *postProcessor
+	postCtx, stopPost := context.WithCancel(context.Background())
+	defer stopPost()
+	if steps := (postProcessing{remux: *remux, bitrate: *transcodeBitrate, daily: *daily}); steps.enabled() && *segment > 0 {
+		post, err = newPostProcessor(*outDir, steps, catalogue)
+		if err != nil {
+			log.Fatalf("Failed to start post-processing: %v", err)
+		}
+		go post.run(postCtx)
+	}
+
+	// Start HTTP server
+	go startHTTPServer(*addr, *port, imageCache, broadcaster, outputs, targets, catalogue, journal, post, redact, encoding, serviceName)
+
+	if frameSource != nil {
+		loop := &captureLoop{
+			cache:       imageCache,
+			broadcaster: broadcaster,
+			source:      frameSource,
+			settings:    capture,
+			encoding:    encoding,
+			outputs:     outputs,
+			targets:     targets,
+			windows:     windows,
+			cropTarget:  screenFrameSources[*stills],
+			redactor:    redact,
+			segments:    segments,
+			locks:       locks,
+		}
+		go loop.run()
+	}
+
+	ctx := context.Background()
 	fullTemplate := filepath.Join(*outDir, *template)
 
-	log.Printf("Starting screencast loop: out=%s segment=%s", *outDir, segment.String())
 	log.Printf("HTTP server running on http://%s:%d", *addr, *port)
 	log.Printf("DBus health check enabled: interval=%s", healthCheckInterval.String())
 
-	// Start the first recording
-	opts := map[string]dbus.Variant{}
-	call := obj.CallWithContext(ctx, startMethod, 0, fullTemplate, opts)
-	if call.Err != nil {
-		log.Fatalf("Failed to start initial screencast: %v", call.Err)
+	// startSegment expands the template and starts a new segment, keeping
+	// the journal of what was asked for and what the backend confirmed
+	var recorder Recorder
+	startSegment := func() error {
+		target := targets.get()
+		filename := segmentFilename(fullTemplate, time.Now())
+		journal.requested(filepath.Base(filename), target.String())
+		written, err := recorder.Start(ctx, filename, target)
+		if err != nil {
+			journal.failed(filepath.Base(filename), err)
+			return err
+		}
+		if written == "" {
+			written = filename
+		}
+		journal.started(filepath.Base(written))
+		segments.start(written, time.Now())
+		return nil
+	}
+
+	// stopSegment ends the oldest segment being recorded and queues it for
+	// post-processing
+	stopSegment := func(reason string) error {
+		err := recorder.Stop(ctx)
+		name := journal.stopped(reason, err)
+		if post != nil {
+			post.segmentDone(name)
+		}
+		return err
+	}
+
+	// Segments cut off by an earlier crash are checked and repaired in the
+	// background; they are listed before recording starts
+	if leftovers, err := listSegments(*outDir); err != nil {
+		log.Printf("Segment integrity scan failed: %v", err)
+	} else {
+		go scanSegments(leftovers, journal)
+	}
+
+	// Recording is paused while the disk is nearly full, the session is
+	// locked or the recorder stopped responding
+	paused, spaceLow, screenLocked := false, false, locks.isLocked()
+
+	// Segment recording is optional; with -segment 0 only stills are captured
+	var segmentTicker *time.Ticker
+	var segmentTick <-chan time.Time
+	if *segment > 0 {
+		recorder, err = newRecorder(*backend, recorderConfig{conn: conn, windows: windows})
+		if err != nil {
+			log.Fatalf("Failed to create capture backend: %v", err)
+		}
+		log.Printf("Starting screencast loop: backend=%s out=%s segment=%s target=%s", *backend, *outDir, segment.String(), targets.get())
+
+		// Start the first recording, unless the session is already locked
+		if screenLocked {
+			log.Printf("Session is locked, recording starts once it is unlocked")
+			paused = true
+			recordingPausedFlag.Set(1)
+		} else if err := startSegment(); err != nil {
+			// Retried at the next health check, e.g. once the window is open
+			log.Printf("Failed to start initial screencast: %v", err)
+			paused = true
+			recordingPausedFlag.Set(1)
+		} else {
+			log.Printf("Started initial recording")
+
+			// Stills sources that only read some codecs refuse to run
+			// rather than stream nothing
+			if checker, ok := frameSource.(segmentChecker); ok {
+				if err := checker.checkSegment(ctx, filepath.Join(*outDir, segments.current())); err != nil {
+					stopSegment("stills source unsupported")
+					log.Fatalf("Stills source %s cannot read the recording: %v", *stills, err)
+				}
+			}
+		}
+
+		segmentTicker = time.NewTicker(*segment)
+		defer segmentTicker.Stop()
+		segmentTick = segmentTicker.C
+	} else {
+		log.Printf("Segment recording disabled")
+	}
+
+	// Old segments are removed and free space watched in the background
+	var lowSpace <-chan bool
+	if recorder != nil {
+		janitor := newSegmentJanitor(*outDir, segmentRetention{
+			keep:     *segmentKeep,
+			maxAge:   *segmentMaxAge,
+			maxBytes: int64(*segmentMaxBytes),
+			minFree:  int64(*minFree),
+
+			processedMaxBytes: int64(*processedMaxBytes),
+		}, segments, post)
+		lowSpace = janitor.lowSpace
+		go janitor.run()
+	}
+	pauseRecording := func(reason string) {
+		if err := stopSegment(reason); err != nil {
+			log.Printf("Stop screencast failed: %v", err)
+		}
+		paused = true
+		recordingPausedFlag.Set(1)
+	}
+	resumeRecording := func() {
+		if err := startSegment(); err != nil {
+			// Stay paused and retry at the next segment boundary
+			log.Printf("Resume screencast failed: %v", err)
+			return
+		}
+		segmentTicker.Reset(*segment)
+		paused = false
+		recordingPausedFlag.Set(0)
+	}
+
+	// checkHealth verifies the recorder, or just the session bus when not recording
+	checkHealth := func() error {
+		if recorder != nil && !paused {
+			return recorder.Health()
+		}
+		return checkDBusConnection(conn)
+	}
+
+	// rotateSegment moves recording to a new segment. Backends that can
+	// record two segments at once start the next one before stopping the
+	// current one, so there are no gaps in coverage.
+	rotateSegment := func() {
+		overlap := recorder.Overlaps()
+		if !overlap {
+			// The backend records one segment at a time, leaving a gap of
+			// -pause between them
+			if err := stopSegment("rotated"); err != nil {
+				log.Printf("Stop screencast failed: %v", err)
+			}
+			time.Sleep(*pause)
+		}
+
+		if err := startSegment(); err != nil {
+			log.Printf("Start next screencast failed: %v", err)
+			// Only a closed session bus means the session is gone
+			if !conn.Connected() {
+				log.Printf("ERROR: DBus session connection closed during segment rotation")
+				log.Printf("Exiting with error code 1 for systemd restart")
+				os.Exit(1)
+			}
+			// Start afresh at the next health check
+			if overlap {
+				pauseRecording("start failed")
+			} else {
+				paused = true
+				recordingPausedFlag.Set(1)
+			}
+			return
+		}
+
+		if overlap {
+			// Now stop the previous recording
+			if err := stopSegment("rotated"); err != nil {
+				log.Printf("Stop previous screencast failed: %v", err)
+			}
+			// Brief pause to ensure clean transition
+			time.Sleep(*pause)
+		}
 	}
-	log.Printf("Started initial recording")
 
 	// Create ticker for health checks
 	healthCheckTicker := time.NewTicker(*healthCheckInterval)
@@ -478,159 +691,91 @@ func main() {
 			// Received shutdown signal
 			log.Printf("\nReceived shutdown signal, cleaning up...")
 			// Stop the screencast
-			obj.CallWithContext(ctx, stopMethod, 0)
+			if recorder != nil {
+				stopSegment("shutdown")
+			}
+			// Interrupt post-processing; the current job runs again on restart
+			if post != nil {
+				stopPost()
+				post.wait()
+			}
 			log.Printf("Shutdown complete")
 			return
 
 		case <-healthCheckTicker.C:
 			// Periodic health check for DBus connection
-			if err := checkDBusConnection(conn); err != nil {
-				log.Printf("ERROR: %v", err)
-				log.Printf("DBus session connection lost (likely due to session pause/lock)")
-				log.Printf("Exiting with error code 1 for systemd restart")
-				// Stop the screencast before exiting
-				obj.CallWithContext(ctx, stopMethod, 0)
-				os.Exit(1)
+			err := checkHealth()
+			if err == nil {
+				// Retry a recording that failed to start
+				if recorder != nil && paused && !spaceLow && !screenLocked {
+					resumeRecording()
+				}
+				continue
 			}
-
-		case <-time.After(*segment):
-			// Wait for the segment duration
-
-			// Start the next recording BEFORE stopping the current one
-			// This ensures continuous coverage with no gaps
-			call = obj.CallWithContext(ctx, startMethod, 0, fullTemplate, opts)
-			if call.Err != nil {
-				log.Printf("Start next screencast failed: %v", call.Err)
-				// Check if this is due to connection loss
-				if err := checkDBusConnection(conn); err != nil {
-					log.Printf("ERROR: DBus connection lost during segment rotation: %v", err)
-					log.Printf("Exiting with error code 1 for systemd restart")
-					os.Exit(1)
+			if conn.Connected() {
+				// The session is still there; pause and retry at the next check
+				log.Printf("Health check failed: %v", err)
+				if recorder != nil && !paused {
+					pauseRecording("recorder unhealthy")
 				}
-				// If we can't start the next one, try to stop and restart cleanly
-				obj.CallWithContext(ctx, stopMethod, 0)
-				time.Sleep(5 * time.Second)
 				continue
 			}
-
-			// Now stop the previous recording
-			// GNOME Shell may have already auto-stopped it when we started the new one
-			call = obj.CallWithContext(ctx, stopMethod, 0)
-			if call.Err != nil {
-				log.Printf("Stop previous screencast failed (may already be stopped): %v", call.Err)
-				// This is often okay - GNOME may auto-stop when starting a new one
+			log.Printf("ERROR: %v", err)
+			log.Printf("DBus session connection closed, the session has ended")
+			log.Printf("Exiting with error code 1 for systemd restart")
+			// Stop the screencast before exiting
+			if recorder != nil && !paused {
+				stopSegment("session bus lost")
+			}
+			os.Exit(1)
+
+		case locked := <-lockChanges:
+			screenLocked = locked
+			publishLockState(broadcaster, imageCache, outputs, locked)
+			if locked {
+				log.Printf("Session locked, pausing recording and capture")
+				if recorder != nil && !paused {
+					pauseRecording("screen locked")
+				}
+			} else {
+				log.Printf("Session unlocked, resuming recording and capture")
+				if recorder != nil && paused && !spaceLow {
+					resumeRecording()
+				}
 			}
 
-			// Brief pause to ensure clean transition
-			time.Sleep(*pause)
+		case <-segmentTick:
+			// Wait for the segment duration
+			if paused {
+				if !spaceLow && !screenLocked {
+					resumeRecording()
+				}
+				continue
+			}
+			rotateSegment()
 
 			// Optional: print progress heartbeat
 			fmt.Print(".")
-		}
-	}
-}
 
-func startScreenCaptureLoop(cache *ImageCache, broadcaster *SSEBroadcaster, interval time.Duration, videoDir string) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		// Find the most recent video file
-		videoFile, err := findMostRecentVideo(videoDir)
-		if err != nil {
-			log.Printf("Failed to find recent video: %v", err)
-			continue
-		}
-
-		// Create temp file for frame extraction
-		tmpFile := filepath.Join(os.TempDir(), fmt.Sprintf("snoopy-frame-%d.jpg", time.Now().UnixNano()))
-
-		// Extract a frame from the video using ffmpeg
-		// Use -sseof to seek from the end, getting a recent frame
-		cmd := exec.Command("ffmpeg",
-			"-loglevel", "error", // Only show errors
-			"-sseof", "-3", // Seek to 3 seconds before end of file
-			"-i", videoFile,
-			"-frames:v", "1", // Extract 1 frame
-			"-q:v", "2", // JPEG quality (2 is high quality)
-			"-y", // Overwrite output file
-			tmpFile,
-		)
-
-		// Capture stderr for error messages
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			log.Printf("Failed to extract frame from %s: %v", filepath.Base(videoFile), err)
-			if stderr.Len() > 0 {
-				log.Printf("ffmpeg error: %s", stderr.String())
+		case <-targets.changed:
+			// Record the new target in a fresh segment straight away
+			log.Printf("Capture target changed to %s", targets.get())
+			if recorder != nil && !paused {
+				rotateSegment()
+				segmentTicker.Reset(*segment)
 			}
-			continue
-		}
-
-		// Read the frame file
-		jpegData, err := os.ReadFile(tmpFile)
-		if err != nil {
-			log.Printf("Failed to read extracted frame: %v", err)
-			os.Remove(tmpFile)
-			continue
-		}
-
-		// Remove temp file
-		os.Remove(tmpFile)
-
-		// Add to cache
-		filename, err := cache.addImage(jpegData)
-		if err != nil {
-			log.Printf("Failed to save screenshot: %v", err)
-			continue
-		}
-
-		// Broadcast to SSE clients
-		imageURL := fmt.Sprintf("/images/%s", filename)
-		broadcaster.broadcast(imageURL)
-		log.Printf("Captured and broadcast image: %s", filename)
-	}
-}
 
-func findMostRecentVideo(dir string) (string, error) {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return "", err
-	}
-
-	var mostRecent string
-	var mostRecentTime time.Time
-
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-
-		name := entry.Name()
-		// Look for video files (mp4 or webm)
-		ext := filepath.Ext(name)
-		if ext != ".mp4" && ext != ".webm" {
-			continue
-		}
-
-		info, err := entry.Info()
-		if err != nil {
-			continue
-		}
-
-		if info.ModTime().After(mostRecentTime) {
-			mostRecentTime = info.ModTime()
-			mostRecent = filepath.Join(dir, name)
+		case low := <-lowSpace:
+			spaceLow = low
+			if low && !paused {
+				log.Printf("Free space in %s below %d bytes, pausing recording", *outDir, int64(*minFree))
+				pauseRecording("low disk space")
+			} else if !low && paused && !screenLocked {
+				log.Printf("Free space in %s recovered, resuming recording", *outDir)
+				resumeRecording()
+			}
 		}
 	}
-
-	if mostRecent == "" {
-		return "", fmt.Errorf("no video files found in %s", dir)
-	}
-
-	return mostRecent, nil
 }
 
 // corsMiddleware adds CORS headers to allow web clients to access the API
@@ -652,7 +797,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func startHTTPServer(addr string, port int, cache *ImageCache, broadcaster *SSEBroadcaster, serviceName string) {
+func startHTTPServer(addr string, port int, cache *ImageCache, broadcaster *SSEBroadcaster, outputs *outputTracker, targets *targetState, catalogue *segmentCatalogue, journal *segmentJournal, post *postProcessor, redact *redactor, encoding imageEncoding, serviceName string) {
 	mux := http.NewServeMux()
 
 	// Serve static HTML at /
@@ -666,14 +811,56 @@ func startHTTPServer(addr string, port int, cache *ImageCache, broadcaster *SSEB
 
 	// SSE endpoint
 	mux.HandleFunc("/sse/image", func(w http.ResponseWriter, r *http.Request) {
-		serveSSE(w, r, cache, broadcaster)
+		serveSSE(w, r, cache, broadcaster, outputs)
+	})
+
+	// Monitor list endpoint
+	mux.HandleFunc("/api/outputs", func(w http.ResponseWriter, r *http.Request) {
+		serveOutputs(w, r, cache, outputs)
+	})
+
+	// Image history and metadata endpoints
+	mux.HandleFunc("/api/images", func(w http.ResponseWriter, r *http.Request) {
+		serveImageHistory(w, r, cache)
+	})
+	mux.HandleFunc("/api/images/", func(w http.ResponseWriter, r *http.Request) {
+		serveImageInfo(w, r, cache)
+	})
+
+	// Capture target endpoint
+	mux.HandleFunc("/api/capture", func(w http.ResponseWriter, r *http.Request) {
+		serveCapture(w, r, targets)
+	})
+
+	// Recorded segment catalogue and downloads
+	mux.HandleFunc("/api/segments", func(w http.ResponseWriter, r *http.Request) {
+		serveSegments(w, r, catalogue)
+	})
+	mux.HandleFunc("/api/segments/journal", func(w http.ResponseWriter, r *http.Request) {
+		serveSegmentJournal(w, r, journal)
+	})
+	mux.HandleFunc("/api/postprocess", func(w http.ResponseWriter, r *http.Request) {
+		servePostProcess(w, r, post)
+	})
+	mux.HandleFunc("/segments/", func(w http.ResponseWriter, r *http.Request) {
+		serveSegment(w, r, catalogue, redact)
+	})
+
+	mux.HandleFunc("/api/frame", func(w http.ResponseWriter, r *http.Request) {
+		serveFrame(w, r, catalogue, outputs, redact, encoding)
+	})
+	mux.HandleFunc("/api/timelapse", func(w http.ResponseWriter, r *http.Request) {
+		serveTimelapse(w, r, cache, catalogue, redact)
 	})
 
 	// Image serving endpoint
 	mux.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
-		serveImage(w, r, cache)
+		serveImage(w, r, cache, encoding)
 	})
 
+	// Metrics
+	mux.Handle("/debug/vars", expvar.Handler())
+
 	// Wrap with CORS middleware
 	handler := corsMiddleware(mux)
 
@@ -721,10 +908,10 @@ func serveIndexHTML(w http.ResponseWriter, r *http.Request, serviceName string)
         }
         .container {
             max-width: 1200px;
-            width: 100%;
+            width: 100%%;
         }
         #screen {
-            width: 100%;
+            width: 100%%;
             height: auto;
             border: 2px solid #333;
             border-radius: 8px;
@@ -744,7 +931,8 @@ func serveIndexHTML(w http.ResponseWriter, r *http.Request, serviceName string)
         <img id="screen" alt="Screen capture">
         <div class="info">
             <span id="timestamp">-</span> |
-            <span id="update-count">Updates: 0</span>
+            <span id="update-count">Updates: 0</span> |
+            <span id="change">Change: -</span>
         </div>
     </div>
 
@@ -753,12 +941,13 @@ func serveIndexHTML(w http.ResponseWriter, r *http.Request, serviceName string)
         const screenEl = document.getElementById('screen');
         const timestampEl = document.getElementById('timestamp');
         const updateCountEl = document.getElementById('update-count');
+        const changeEl = document.getElementById('change');
         let updateCount = 0;
 
         // Set initial waiting image
         screenEl.src = '/images/waiting.jpg';
 
-        const eventSource = new EventSource('/sse/image');
+        const eventSource = new EventSource('/sse/image?format=json');
 
         eventSource.onopen = function() {
             statusEl.textContent = 'Connected';
@@ -766,13 +955,28 @@ func serveIndexHTML(w http.ResponseWriter, r *http.Request, serviceName string)
         };
 
         eventSource.onmessage = function(event) {
-            const imageUrl = event.data;
-            screenEl.src = imageUrl + '?t=' + Date.now(); // Cache bust
+            const image = JSON.parse(event.data);
+            screenEl.src = image.url + '?t=' + Date.now(); // Cache bust
+            if (image.change !== undefined) {
+                changeEl.textContent = 'Change: ' + (image.change * 100).toFixed(1) + '%%';
+            }
             updateCount++;
             updateCountEl.textContent = 'Updates: ' + updateCount;
             timestampEl.textContent = new Date().toLocaleTimeString();
         };
 
+        eventSource.addEventListener('locked', function(event) {
+            screenEl.src = JSON.parse(event.data).url;
+            statusEl.textContent = 'Session locked';
+            statusEl.className = 'status disconnected';
+        });
+
+        eventSource.addEventListener('unlocked', function(event) {
+            screenEl.src = JSON.parse(event.data).url + '?t=' + Date.now();
+            statusEl.textContent = 'Connected';
+            statusEl.className = 'status connected';
+        });
+
         eventSource.onerror = function() {
             statusEl.textContent = 'Disconnected - Reconnecting...';
             statusEl.className = 'status disconnected';
@@ -785,20 +989,34 @@ func serveIndexHTML(w http.ResponseWriter, r *http.Request, serviceName string)
 	w.Write([]byte(html))
 }
 
-func serveSSE(w http.ResponseWriter, r *http.Request, cache *ImageCache, broadcaster *SSEBroadcaster) {
+func serveSSE(w http.ResponseWriter, r *http.Request, cache *ImageCache, broadcaster *SSEBroadcaster, outputs *outputTracker) {
+	// Each monitor has its own stream; without ?output= the whole desktop
+	output := r.URL.Query().Get("output")
+	if output != "" && !outputs.streaming(output) {
+		http.Error(w, "unknown output", http.StatusNotFound)
+		return
+	}
+
 	// Set SSE headers
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
+	// Clients asking for ?format=json receive the change score with each
+	// image; everyone else gets the bare image path
+	jsonEvents := r.URL.Query().Get("format") == "json"
+
 	// Create client channel
-	clientChan := make(chan string, 10)
+	clientChan := make(chan imageEvent, 10)
 	broadcaster.addClient(clientChan)
 	defer broadcaster.removeClient(clientChan)
 
-	// Send initial image
-	initialImage := cache.getLatest()
-	fmt.Fprintf(w, "data: /images/%s\n\n", initialImage)
+	// Send initial image, or the lock placeholder while the session is locked
+	if broadcaster.isLocked() {
+		writeImageEvent(w, imageEvent{URL: "/images/" + lockedImage, Output: output, State: stateLocked}, jsonEvents)
+	} else {
+		writeImageEvent(w, imageEvent{URL: "/images/" + cache.getLatest(output), Output: output}, jsonEvents)
+	}
 	if f, ok := w.(http.Flusher); ok {
 		f.Flush()
 	}
@@ -810,7 +1028,10 @@ func serveSSE(w http.ResponseWriter, r *http.Request, cache *ImageCache, broadca
 		case <-ctx.Done():
 			return
 		case msg := <-clientChan:
-			fmt.Fprintf(w, "data: %s\n\n", msg)
+			if msg.Output != output {
+				continue
+			}
+			writeImageEvent(w, msg, jsonEvents)
 			if f, ok := w.(http.Flusher); ok {
 				f.Flush()
 			}
@@ -818,21 +1039,534 @@ func serveSSE(w http.ResponseWriter, r *http.Request, cache *ImageCache, broadca
 	}
 }
 
-func serveImage(w http.ResponseWriter, r *http.Request, cache *ImageCache) {
-	// Extract filename from path
-	filename := filepath.Base(r.URL.Path)
+// outputInfo describes a monitor in the /api/outputs response
+type outputInfo struct {
+	displayOutput
+	Streaming bool   `json:"streaming"`
+	SSE       string `json:"sse,omitempty"`
+	Latest    string `json:"latest,omitempty"`
+}
 
-	// Get full path
-	imagePath := cache.getImagePath(filename)
+func serveOutputs(w http.ResponseWriter, r *http.Request, cache *ImageCache, outputs *outputTracker) {
+	if err := outputs.refresh(); err != nil {
+		log.Printf("Failed to enumerate outputs: %v", err)
+	}
+
+	list := []outputInfo{}
+	for _, o := range outputs.list() {
+		info := outputInfo{displayOutput: o, Streaming: outputs.streaming(o.Name)}
+		if info.Streaming {
+			info.SSE = "/sse/image?output=" + url.QueryEscape(o.Name)
+			info.Latest = "/images/" + cache.getLatest(o.Name)
+		}
+		list = append(list, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
 
-	// Check if file exists
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+// imageInfo describes a cached image in the /api/images responses
+type imageInfo struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	imageMeta
+}
+
+// newImageInfo describes a cached image for API clients
+func newImageInfo(img cachedImage) imageInfo {
+	return imageInfo{ID: imageID(img.Name), URL: "/images/" + img.Name, imageMeta: img.imageMeta}
+}
+
+// Page sizes of /api/images
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// imageHistory is the /api/images response
+type imageHistory struct {
+	Images []imageInfo `json:"images"`           // oldest first
+	More   bool        `json:"more"`             // further images match beyond the limit
+	Missed bool        `json:"missed,omitempty"` // the after cursor was pruned, so images may have been skipped
+}
+
+// serveImageHistory lists cached images of an output (?output=, the whole
+// desktop by default) between the ?after= and ?before= cursors, each an
+// image ID or an RFC 3339 time
+func serveImageHistory(w http.ResponseWriter, r *http.Request, cache *ImageCache) {
+	query := r.URL.Query()
+	limit := defaultHistoryLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	images, more, missed, err := cache.history(query.Get("output"),
+		parseImageCursor(query.Get("after")), parseImageCursor(query.Get("before")), limit)
+	if errors.Is(err, errUnknownImage) {
+		http.Error(w, "unknown image in cursor", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	history := imageHistory{Images: make([]imageInfo, 0, len(images)), More: more, Missed: missed}
+	for _, img := range images {
+		history.Images = append(history.Images, newImageInfo(img))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// parseImageCursor reads a history cursor, which is a time if it parses as
+// RFC 3339 and an image ID otherwise
+func parseImageCursor(s string) imageCursor {
+	if s == "" {
+		return imageCursor{}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return imageCursor{time: t}
+	}
+	return imageCursor{id: s}
+}
+
+// serveImageInfo returns the metadata of one image at /api/images/{id}, or
+// of the newest image of an output at /api/images/latest
+func serveImageInfo(w http.ResponseWriter, r *http.Request, cache *ImageCache) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/images/")
+	var img cachedImage
+	var ok bool
+	if id == "latest" {
+		img, ok = cache.latestImage(r.URL.Query().Get("output"))
+	} else {
+		img, ok = cache.lookup(id)
+	}
+	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newImageInfo(img))
+}
 
-	// Serve the image
-	w.Header().Set("Content-Type", "image/jpeg")
+// serveCapture reports the capture target on GET and replaces it on POST
+func serveCapture(w http.ResponseWriter, r *http.Request, targets *targetState) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var target captureTarget
+		if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+			http.Error(w, fmt.Sprintf("invalid capture target: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := targets.set(target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets.get())
+}
+
+// serveSegments lists the recorded segments, oldest first
+func serveSegments(w http.ResponseWriter, r *http.Request, catalogue *segmentCatalogue) {
+	segments, err := catalogue.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(segments)
+}
+
+// How long /api/timelapse may take
+const timelapseTimeout = 10 * time.Minute
+
+// timelapseSlot lets one timelapse be made at a time
+var timelapseSlot = make(chan struct{}, 1)
+
+// serveTimelapse makes a timelapse between ?from= and ?to= (RFC 3339, now
+// by default) at ?speed= times real time (default 60) and ?fps= (default
+// 30), from cached images of ?output= or, with ?source=segments, from
+// recorded video, encoded as ?format= mp4 (default), webm or webp.
+// Recordings are not redacted, so only cached images are used while
+// redaction rules are set.
+func serveTimelapse(w http.ResponseWriter, r *http.Request, cache *ImageCache, catalogue *segmentCatalogue, redact *redactor) {
+	query := r.URL.Query()
+	spec := timelapseSpec{
+		speed:  60,
+		fps:    30,
+		source: timelapseImages,
+		output: query.Get("output"),
+		format: "mp4",
+		to:     time.Now(),
+	}
+	var err error
+	if spec.from, err = parseTimeParam(query, "from"); err != nil || spec.from.IsZero() {
+		http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(query, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !to.IsZero() {
+		spec.to = to
+	}
+	if v := query.Get("speed"); v != "" {
+		if spec.speed, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, "speed must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("fps"); v != "" {
+		if spec.fps, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "fps must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("source"); v != "" {
+		spec.source = v
+	}
+	if v := query.Get("format"); v != "" {
+		spec.format = v
+	}
+	if err := spec.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if spec.source == timelapseSegments && redact != nil {
+		http.Error(w, "recorded segments are not redacted and cannot be used while -redact is set", http.StatusForbidden)
+		return
+	}
+
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		http.Error(w, "timelapses require ffmpeg", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case timelapseSlot <- struct{}{}:
+		defer func() { <-timelapseSlot }()
+	default:
+		http.Error(w, "another timelapse is being made", http.StatusTooManyRequests)
+		return
+	}
+
+	out, err := os.CreateTemp("", "snoopy-timelapse-*."+spec.format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	ctx, cancel := context.WithTimeout(r.Context(), timelapseTimeout)
+	defer cancel()
+	var images []cachedImage
+	if spec.source == timelapseImages {
+		images = cache.between(spec.output, spec.from, spec.to)
+	}
+	err = makeTimelapse(ctx, spec, cache.dir, images, catalogue, out.Name())
+	if errors.Is(err, errNoFrames) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to make timelapse: %v", err)
+		http.Error(w, "make timelapse", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", timelapseFormats[spec.format].contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="timelapse-%s.%s"`,
+		spec.from.UTC().Format("20060102-150405"), spec.format))
+	http.ServeFile(w, r, out.Name())
+}
+
+// serveSegmentJournal returns the segment journal between the ?since= and
+// ?until= RFC 3339 times, optionally filtered by ?event=, e.g. event=gap
+// for the gaps in coverage
+func serveSegmentJournal(w http.ResponseWriter, r *http.Request, journal *segmentJournal) {
+	query := r.URL.Query()
+	since, err := parseTimeParam(query, "since")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseTimeParam(query, "until")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(journal.query(since, until, query.Get("event")))
+}
+
+// parseTimeParam reads an optional RFC 3339 time from the query
+func parseTimeParam(query url.Values, name string) (time.Time, error) {
+	v := query.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return t, nil
+}
+
+// servePostProcess lists the queued and failed post-processing jobs
+func servePostProcess(w http.ResponseWriter, r *http.Request, post *postProcessor) {
+	if post == nil {
+		http.Error(w, "post-processing is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(post.jobs())
+}
+
+// Content types of recorded segments, which mime does not always know
+var segmentContentTypes = map[string]string{
+	".webm": "video/webm",
+	".mp4":  "video/mp4",
+}
+
+// serveSegment serves a recorded segment at /segments/{name}. Range
+// requests are supported so players can seek. Recordings are not redacted,
+// so none are served while redaction rules are set.
+func serveSegment(w http.ResponseWriter, r *http.Request, catalogue *segmentCatalogue, redact *redactor) {
+	if redact != nil {
+		http.Error(w, "recorded segments are not redacted and are not served while -redact is set", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/segments/")
+	if name != filepath.Base(name) {
+		http.NotFound(w, r)
+		return
+	}
+	info, ok := catalogue.lookup(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", segmentContentTypes[filepath.Ext(name)])
+	if info.Recording {
+		// The segment is still growing
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeFile(w, r, catalogue.path(name))
+}
+
+// How long /api/frame waits for ffmpeg
+const frameExtractTimeout = 30 * time.Second
+
+// serveFrame extracts the frame on screen at ?at= (RFC 3339) from the
+// segment recorded then, in the stored image format unless another is asked
+// for with ?format= or the Accept header. ?w= scales it down. Recordings are
+// not redacted, so the redaction rules are applied here; frames they cannot
+// be applied to are refused.
+func serveFrame(w http.ResponseWriter, r *http.Request, catalogue *segmentCatalogue, outputs *outputTracker, redact *redactor, encoding imageEncoding) {
+	query := r.URL.Query()
+	at, err := time.Parse(time.RFC3339Nano, query.Get("at"))
+	if err != nil {
+		http.Error(w, "at must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	format := negotiateFormat(r.Header.Get("Accept"), encoding.format)
+	if want := query.Get("format"); want != "" {
+		if format, err = lookupImageFormat(want); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var width int
+	if wq := query.Get("w"); wq != "" {
+		width, err = strconv.Atoi(wq)
+		if err != nil || width < 1 || width > maxResizeWidth {
+			http.Error(w, fmt.Sprintf("w must be between 1 and %d", maxResizeWidth), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		http.Error(w, "frame extraction requires ffmpeg", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), frameExtractTimeout)
+	defer cancel()
+	img, segment, err := catalogue.frameAt(ctx, at)
+	if errors.Is(err, errNoRecording) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to extract frame: %v", err)
+		http.Error(w, "extract frame", http.StatusInternalServerError)
+		return
+	}
+
+	if redact != nil {
+		// Regions are in desktop coordinates, which only map onto
+		// recordings of the whole desktop
+		if catalogue.journal.target(segment.Name) != (captureTarget{Mode: targetScreen}).String() {
+			http.Error(w, "frames recorded from part of the desktop cannot be redacted", http.StatusForbidden)
+			return
+		}
+		if err := outputs.refresh(); err != nil {
+			log.Printf("Failed to enumerate outputs: %v", err)
+		}
+		area := outputs.desktopBounds()
+		if area.Empty() {
+			area = img.Bounds()
+		}
+		if img, err = redact.applyRecorded(img, area); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	img = fitImage(img, encoding.maxDimension)
+	if width > 0 {
+		img = resizeToWidth(img, width)
+	}
+	data, err := format.encode(img, encoding.quality)
+	if err != nil {
+		log.Printf("Failed to encode frame: %v", err)
+		http.Error(w, "encode frame", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Vary", "Accept")
+	if !segment.Recording {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Write(data)
+}
+
+// writeImageEvent writes an image event in SSE format. JSON clients receive
+// lock state changes as "locked" and "unlocked" events; others just see the
+// placeholder or the latest image.
+func writeImageEvent(w http.ResponseWriter, event imageEvent, asJSON bool) {
+	if !asJSON {
+		fmt.Fprintf(w, "data: %s\n\n", event.URL)
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode SSE event: %v", err)
+		return
+	}
+	if event.State != "" {
+		fmt.Fprintf(w, "event: %s\n", event.State)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// publishLockState tells SSE clients of every stream that the session was
+// locked, showing the lock placeholder, or unlocked, showing the latest
+// image again
+func publishLockState(broadcaster *SSEBroadcaster, cache *ImageCache, outputs *outputTracker, locked bool) {
+	broadcaster.setLocked(locked)
+	streams := []string{""}
+	for _, o := range outputs.streamed() {
+		streams = append(streams, o.Name)
+	}
+	for _, output := range streams {
+		event := imageEvent{URL: "/images/" + lockedImage, Output: output, State: stateLocked}
+		if !locked {
+			event = imageEvent{URL: "/images/" + cache.getLatest(output), Output: output, State: stateUnlocked}
+		}
+		broadcaster.broadcast(event)
+	}
+}
+
+// Widest resize served by /images/{id}?w=
+const maxResizeWidth = 4096
+
+// serveImage serves a cached image in the stored format, or resized with ?w=
+// and converted to the format asked for with ?format= or the Accept header
+func serveImage(w http.ResponseWriter, r *http.Request, cache *ImageCache, encoding imageEncoding) {
+	// Extract the image ID from the path; any extension is ignored
+	name := filepath.Base(r.URL.Path)
+	id := strings.TrimSuffix(name, filepath.Ext(name))
+
+	filename, ok := cache.find(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	imagePath := cache.getImagePath(filename)
+	stored := formatByExt(filepath.Ext(filename))
+	if stored == nil {
+		http.Error(w, "unknown image format", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	format := negotiateFormat(r.Header.Get("Accept"), stored)
+	if want := query.Get("format"); want != "" {
+		var err error
+		if format, err = lookupImageFormat(want); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	variant := imageVariant{format: format, quality: encoding.quality}
+	if q := query.Get("quality"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "quality must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		variant.quality = n
+	}
+	if width := query.Get("w"); width != "" {
+		n, err := strconv.Atoi(width)
+		if err != nil || n < 1 || n > maxResizeWidth {
+			http.Error(w, fmt.Sprintf("w must be between 1 and %d", maxResizeWidth), http.StatusBadRequest)
+			return
+		}
+		variant.width = n
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
 	w.Header().Set("Cache-Control", "public, max-age=3600")
-	http.ServeFile(w, r, imagePath)
+	w.Header().Set("Vary", "Accept")
+
+	// Serve the stored file directly when no conversion is needed
+	if format == stored && query.Get("quality") == "" && query.Get("w") == "" {
+		http.ServeFile(w, r, imagePath)
+		return
+	}
+
+	// Resized and converted copies are cached next to the original
+	path, err := cache.derivative(filename, stored, variant)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to convert image: %v", err)
+		http.Error(w, "convert image", http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, path)
 }
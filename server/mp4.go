@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// mp4Box finds the first box of a type among the boxes between start and
+// end, walking them by their sizes, and returns the offset and size of its
+// payload. A box cut off by the end of the file is not found.
+func mp4Box(f *os.File, start, end int64, typ string) (int64, int64, bool, error) {
+	var header [16]byte
+	offset := start
+	for offset+8 <= end {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			if err == io.EOF {
+				return 0, 0, false, nil
+			}
+			return 0, 0, false, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerLen := int64(8)
+		switch size {
+		case 0:
+			// The box runs to the end
+			size = end - offset
+		case 1:
+			// 64-bit size follows the type
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return 0, 0, false, nil
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+		if size < headerLen {
+			return 0, 0, false, nil
+		}
+		if string(header[4:8]) == typ {
+			return offset + headerLen, size - headerLen, true, nil
+		}
+		offset += size
+	}
+	return 0, 0, false, nil
+}
+
+// mp4VideoSize reads the display size of the first video track of an MP4
+// file from its track header
+func mp4VideoSize(path string) (image.Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Point{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return image.Point{}, err
+	}
+
+	moov, moovSize, ok, err := mp4Box(f, 0, info.Size(), "moov")
+	if err != nil || !ok {
+		return image.Point{}, fmt.Errorf("%s has no moov box", path)
+	}
+	for offset := moov; ; {
+		trak, trakSize, ok, err := mp4Box(f, offset, moov+moovSize, "trak")
+		if err != nil || !ok {
+			break
+		}
+		offset = trak + trakSize
+
+		// Width and height end the track header, as 16.16 fixed point
+		tkhd, tkhdSize, ok, err := mp4Box(f, trak, trak+trakSize, "tkhd")
+		if err != nil || !ok || tkhdSize < 8 {
+			continue
+		}
+		var dims [8]byte
+		if _, err := f.ReadAt(dims[:], tkhd+tkhdSize-8); err != nil {
+			continue
+		}
+		w, h := binary.BigEndian.Uint32(dims[:4])>>16, binary.BigEndian.Uint32(dims[4:])>>16
+		if w > 0 && h > 0 {
+			return image.Pt(int(w), int(h)), nil
+		}
+	}
+	return image.Point{}, fmt.Errorf("%s has no video track", path)
+}
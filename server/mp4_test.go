@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"os"
+	"testing"
+)
+
+// mp4BoxBytes encodes a box with a 32-bit size
+func mp4BoxBytes(typ string, children ...[]byte) []byte {
+	payload := bytes.Join(children, nil)
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], typ)
+	return append(b, payload...)
+}
+
+// mp4LargeBoxBytes encodes a box with a 64-bit size
+func mp4LargeBoxBytes(typ string, payload []byte) []byte {
+	b := make([]byte, 16, 16+len(payload))
+	binary.BigEndian.PutUint32(b, 1)
+	copy(b[4:], typ)
+	binary.BigEndian.PutUint64(b[8:], uint64(16+len(payload)))
+	return append(b, payload...)
+}
+
+// mp4TrackHeader encodes a version 0 tkhd box for the given display size
+func mp4TrackHeader(width, height uint32) []byte {
+	payload := make([]byte, 84)
+	binary.BigEndian.PutUint32(payload[76:], width<<16)
+	binary.BigEndian.PutUint32(payload[80:], height<<16)
+	return mp4BoxBytes("tkhd", payload)
+}
+
+func TestMP4Box(t *testing.T) {
+	ftyp := mp4BoxBytes("ftyp", []byte("isom"))
+	tests := []struct {
+		name     string
+		data     []byte
+		typ      string
+		wantOff  int64
+		wantSize int64
+		wantOK   bool
+	}{
+		{name: "first box", data: ftyp, typ: "ftyp", wantOff: 8, wantSize: 4, wantOK: true},
+		{name: "after others", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("free"), mp4BoxBytes("moov", make([]byte, 10))}, nil), typ: "moov", wantOff: 28, wantSize: 10, wantOK: true},
+		{name: "64-bit size", data: append(mp4LargeBoxBytes("mdat", make([]byte, 32)), mp4BoxBytes("moov")...), typ: "moov", wantOff: 56, wantSize: 0, wantOK: true},
+		{name: "64-bit size found", data: mp4LargeBoxBytes("mdat", make([]byte, 32)), typ: "mdat", wantOff: 16, wantSize: 32, wantOK: true},
+		{name: "size zero runs to end", data: append(ftyp, 0, 0, 0, 0, 'm', 'd', 'a', 't', 1, 2, 3), typ: "mdat", wantOff: 20, wantSize: 3, wantOK: true},
+		{name: "missing", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("mdat", make([]byte, 100))}, nil), typ: "moov"},
+		{name: "cut off header", data: append(ftyp, 0, 0, 0), typ: "moov"},
+		{name: "size below header", data: []byte{0, 0, 0, 4, 'm', 'o', 'o', 'v'}, typ: "moov"},
+		{name: "empty", data: nil, typ: "moov"},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(writeTestFile(t, "box.mp4", tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		off, size, ok, err := mp4Box(f, 0, int64(len(tt.data)), tt.typ)
+		f.Close()
+		if err != nil || ok != tt.wantOK || off != tt.wantOff || size != tt.wantSize {
+			t.Errorf("%s: got %d, %d, %v, %v, want %d, %d, %v", tt.name, off, size, ok, err, tt.wantOff, tt.wantSize, tt.wantOK)
+		}
+	}
+}
+
+func TestMP4VideoSize(t *testing.T) {
+	ftyp := mp4BoxBytes("ftyp", []byte("isom"))
+	audio := mp4BoxBytes("trak", mp4TrackHeader(0, 0), mp4BoxBytes("mdia"))
+	video := mp4BoxBytes("trak", mp4TrackHeader(1280, 720), mp4BoxBytes("mdia"))
+	tests := []struct {
+		name    string
+		data    []byte
+		want    image.Point
+		wantErr bool
+	}{
+		{name: "video track", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("moov", mp4BoxBytes("mvhd"), video)}, nil), want: image.Pt(1280, 720)},
+		{name: "after audio track", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("moov", audio, video), mp4BoxBytes("mdat")}, nil), want: image.Pt(1280, 720)},
+		{name: "audio only", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("moov", audio)}, nil), wantErr: true},
+		{name: "no moov", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("mdat", make([]byte, 64))}, nil), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := mp4VideoSize(writeTestFile(t, "video.mp4", tt.data))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %v, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %v (%v), want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestMP4HasMovie(t *testing.T) {
+	ftyp := mp4BoxBytes("ftyp", []byte("isom"))
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{name: "finished", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("mdat", make([]byte, 64)), mp4BoxBytes("moov")}, nil), want: true},
+		{name: "faststart", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("moov"), mp4BoxBytes("mdat", make([]byte, 64))}, nil), want: true},
+		{name: "cut off before moov", data: bytes.Join([][]byte{ftyp, mp4BoxBytes("mdat", make([]byte, 64))}, nil)},
+		{name: "mdat still open", data: append(ftyp, 0, 0, 0, 0, 'm', 'd', 'a', 't', 1, 2, 3)},
+	}
+	for _, tt := range tests {
+		got, err := mp4HasMovie(writeTestFile(t, "segment.mp4", tt.data))
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %v (%v), want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
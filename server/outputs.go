@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	displayConfigDest  = "org.gnome.Mutter.DisplayConfig"
+	displayConfigPath  = "/org/gnome/Mutter/DisplayConfig"
+	displayConfigIface = "org.gnome.Mutter.DisplayConfig"
+
+	// Mutter layout modes
+	mutterLayoutLogical = 1
+
+	// How long an enumerated output list is reused before asking again
+	outputRefreshInterval = 10 * time.Second
+)
+
+// displayOutput is a monitor and its area within the desktop
+type displayOutput struct {
+	Name    string `json:"name"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Primary bool   `json:"primary"`
+}
+
+// bounds returns the output's rectangle in desktop coordinates
+func (o displayOutput) bounds() image.Rectangle {
+	return image.Rect(o.X, o.Y, o.X+o.Width, o.Y+o.Height)
+}
+
+// outputLister enumerates the monitors making up the desktop
+type outputLister interface {
+	Outputs() ([]displayOutput, error)
+}
+
+// mutterOutputLister reads the monitor layout from Mutter's DisplayConfig
+// D-Bus API
+type mutterOutputLister struct {
+	obj dbus.BusObject
+}
+
+type mutterMonitorSpec struct {
+	Connector string
+	Vendor    string
+	Product   string
+	Serial    string
+}
+
+type mutterMode struct {
+	ID              string
+	Width           int32
+	Height          int32
+	Refresh         float64
+	PreferredScale  float64
+	SupportedScales []float64
+	Properties      map[string]dbus.Variant
+}
+
+type mutterMonitor struct {
+	Spec       mutterMonitorSpec
+	Modes      []mutterMode
+	Properties map[string]dbus.Variant
+}
+
+type mutterLogicalMonitor struct {
+	X          int32
+	Y          int32
+	Scale      float64
+	Transform  uint32
+	Primary    bool
+	Monitors   []mutterMonitorSpec
+	Properties map[string]dbus.Variant
+}
+
+func newMutterOutputLister(conn *dbus.Conn) *mutterOutputLister {
+	return &mutterOutputLister{
+		obj: conn.Object(displayConfigDest, dbus.ObjectPath(displayConfigPath)),
+	}
+}
+
+// Outputs returns one output per logical monitor, named after the
+// connector of its first physical monitor
+func (m *mutterOutputLister) Outputs() ([]displayOutput, error) {
+	var serial uint32
+	var monitors []mutterMonitor
+	var logical []mutterLogicalMonitor
+	var props map[string]dbus.Variant
+	err := m.obj.Call(displayConfigIface+".GetCurrentState", 0).Store(&serial, &monitors, &logical, &props)
+	if err != nil {
+		return nil, fmt.Errorf("get display state: %w", err)
+	}
+
+	layoutMode := uint32(0)
+	if v, ok := props["layout-mode"]; ok {
+		layoutMode, _ = v.Value().(uint32)
+	}
+
+	// Current mode size of each connector
+	modes := make(map[string][2]int32)
+	for _, mon := range monitors {
+		for _, mode := range mon.Modes {
+			if current, _ := mode.Properties["is-current"].Value().(bool); current {
+				modes[mon.Spec.Connector] = [2]int32{mode.Width, mode.Height}
+			}
+		}
+	}
+
+	var outputs []displayOutput
+	for _, lm := range logical {
+		if len(lm.Monitors) == 0 {
+			continue
+		}
+		name := lm.Monitors[0].Connector
+		size, ok := modes[name]
+		if !ok {
+			continue
+		}
+		w, h := float64(size[0]), float64(size[1])
+		// Transforms 1, 3, 5 and 7 rotate by 90 or 270 degrees
+		if lm.Transform%2 == 1 {
+			w, h = h, w
+		}
+		if layoutMode == mutterLayoutLogical && lm.Scale > 0 {
+			w, h = w/lm.Scale, h/lm.Scale
+		}
+		outputs = append(outputs, displayOutput{
+			Name:    name,
+			X:       int(lm.X),
+			Y:       int(lm.Y),
+			Width:   int(w + 0.5),
+			Height:  int(h + 0.5),
+			Primary: lm.Primary,
+		})
+	}
+	return outputs, nil
+}
+
+// outputTracker keeps the current monitor layout and which outputs get
+// their own stream
+type outputTracker struct {
+	lister   outputLister
+	all      bool
+	selected map[string]bool
+
+	mu      sync.RWMutex
+	outputs []displayOutput
+	updated time.Time
+}
+
+// newOutputTracker parses the -outputs flag: empty streams the whole
+// desktop only, "all" streams every output, otherwise a comma separated
+// list of output names
+func newOutputTracker(lister outputLister, selection string) *outputTracker {
+	t := &outputTracker{lister: lister, selected: make(map[string]bool)}
+	for _, name := range strings.Split(selection, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case "all":
+			t.all = true
+		default:
+			t.selected[name] = true
+		}
+	}
+	return t
+}
+
+// enabled reports whether any per-output streams were requested
+func (t *outputTracker) enabled() bool {
+	return t.lister != nil && (t.all || len(t.selected) > 0)
+}
+
+// refresh re-enumerates outputs if the cached layout is stale
+func (t *outputTracker) refresh() error {
+	if t.lister == nil {
+		return nil
+	}
+	t.mu.RLock()
+	fresh := time.Since(t.updated) < outputRefreshInterval
+	t.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	outputs, err := t.lister.Outputs()
+	if err != nil {
+		return err
+	}
+	sort.Slice(outputs, func(i, j int) bool {
+		if outputs[i].X != outputs[j].X {
+			return outputs[i].X < outputs[j].X
+		}
+		return outputs[i].Y < outputs[j].Y
+	})
+
+	t.mu.Lock()
+	t.outputs = outputs
+	t.updated = time.Now()
+	t.mu.Unlock()
+	return nil
+}
+
+// list returns every known output
+func (t *outputTracker) list() []displayOutput {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]displayOutput(nil), t.outputs...)
+}
+
+// streaming reports whether an output has its own stream
+func (t *outputTracker) streaming(name string) bool {
+	return t.enabled() && (t.all || t.selected[name])
+}
+
+// streamed returns the outputs that have their own stream
+func (t *outputTracker) streamed() []displayOutput {
+	var outputs []displayOutput
+	for _, o := range t.list() {
+		if t.streaming(o.Name) {
+			outputs = append(outputs, o)
+		}
+	}
+	return outputs
+}
+
+// desktopBounds returns the rectangle covering all outputs
+func (t *outputTracker) desktopBounds() image.Rectangle {
+	var r image.Rectangle
+	for _, o := range t.list() {
+		r = r.Union(o.bounds())
+	}
+	return r
+}
+
+// cropToDesktopRect cuts a rectangle given in desktop coordinates out of
+// a whole-desktop frame, scaling desktop coordinates to the frame's pixel
+// size
+func cropToDesktopRect(img image.Image, r image.Rectangle, desktop image.Rectangle) (image.Image, error) {
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok || desktop.Empty() {
+		return nil, fmt.Errorf("cannot crop frame")
+	}
+
+	crop := desktopToFrame(r, desktop, img.Bounds())
+	if crop.Empty() {
+		return nil, fmt.Errorf("area lies outside the captured frame")
+	}
+	return sub.SubImage(crop), nil
+}
+
+// desktopToFrame maps a rectangle in desktop coordinates to the pixels of
+// a frame showing the given desktop area, clipped to the frame
+func desktopToFrame(r, area, frame image.Rectangle) image.Rectangle {
+	sx := float64(frame.Dx()) / float64(area.Dx())
+	sy := float64(frame.Dy()) / float64(area.Dy())
+	o := r.Sub(area.Min)
+	return image.Rect(
+		frame.Min.X+int(float64(o.Min.X)*sx+0.5),
+		frame.Min.Y+int(float64(o.Min.Y)*sy+0.5),
+		frame.Min.X+int(float64(o.Max.X)*sx+0.5),
+		frame.Min.Y+int(float64(o.Max.Y)*sy+0.5),
+	).Intersect(frame)
+}
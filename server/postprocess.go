@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory under -out that processed segments are written to. It is not
+// subject to segment retention.
+const processedDir = "processed"
+
+// postProcessJobsFile is the persisted job queue in the processed directory
+const postProcessJobsFile = "jobs.json"
+
+const (
+	// Segments written to this recently may still be finalised by the
+	// backend and are left alone
+	postProcessSettle = 10 * time.Second
+
+	// Attempts before a job is given up
+	postProcessAttempts = 3
+
+	// Wait before a failed job is retried, multiplied by its attempts
+	postProcessRetryDelay = time.Minute
+
+	// Failed jobs kept for /api/postprocess
+	maxFailedJobs = 50
+)
+
+// Post-processing job kinds
+const (
+	jobMP4   = "mp4"   // remux or transcode a segment to MP4
+	jobDaily = "daily" // append a processed segment to its day's file
+)
+
+// Post-processing metrics, served at /debug/vars
+var (
+	postProcessPending = expvar.NewInt("postprocess_jobs_pending")
+	postProcessFailed  = expvar.NewInt("postprocess_jobs_failed")
+)
+
+// postProcessing selects the steps applied to finished segments
+type postProcessing struct {
+	remux   bool   // write an MP4 copy of each segment
+	bitrate string // re-encode to H.264 at this bitrate instead of copying
+	daily   bool   // concatenate the MP4s into one file per day
+}
+
+func (p postProcessing) enabled() bool {
+	return p.remux || p.bitrate != "" || p.daily
+}
+
+// postProcessJob is a queued step for one segment
+type postProcessJob struct {
+	Kind     string    `json:"kind"`
+	Segment  string    `json:"segment"`
+	Input    string    `json:"input"`
+	Output   string    `json:"output"`
+	Created  time.Time `json:"created"`
+	Attempts int       `json:"attempts,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Staged   bool      `json:"staged,omitempty"` // the daily file was written next to Output and only needs moving into place
+}
+
+// postProcessQueue is the persisted state of the pipeline
+type postProcessQueue struct {
+	Pending []postProcessJob `json:"pending"`
+	Failed  []postProcessJob `json:"failed"`
+}
+
+// postProcessor runs post-processing jobs one at a time in the background.
+// Jobs are saved before they run and removed once done, so work queued
+// before a restart is picked up again.
+type postProcessor struct {
+	dir       string // processed directory
+	steps     postProcessing
+	catalogue *segmentCatalogue
+
+	mu    sync.Mutex
+	queue postProcessQueue
+	wake  chan struct{}
+	done  chan struct{} // closed when run returns
+}
+
+func newPostProcessor(outDir string, steps postProcessing, catalogue *segmentCatalogue) (*postProcessor, error) {
+	p := &postProcessor{
+		dir:       filepath.Join(outDir, processedDir),
+		steps:     steps,
+		catalogue: catalogue,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if err := os.MkdirAll(filepath.Join(p.dir, "daily"), 0o755); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(p.dir, postProcessJobsFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &p.queue); err != nil {
+			log.Printf("Post-processing queue is damaged, starting empty: %v", err)
+			p.queue = postProcessQueue{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read post-processing queue: %w", err)
+	}
+	if n := len(p.queue.Pending); n > 0 {
+		log.Printf("Post-processing: resuming %d queued jobs", n)
+	}
+	p.updateMetrics()
+	return p, nil
+}
+
+// segmentDone queues the processing of a segment that stopped recording
+func (p *postProcessor) segmentDone(name string) {
+	if name == "" {
+		return
+	}
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	p.enqueue(postProcessJob{
+		Kind:    jobMP4,
+		Segment: name,
+		Input:   p.catalogue.path(name),
+		Output:  filepath.Join(p.dir, base+".mp4"),
+	})
+}
+
+// enqueue adds a job and wakes the worker
+func (p *postProcessor) enqueue(job postProcessJob) {
+	job.Created = time.Now()
+	p.mu.Lock()
+	p.queue.Pending = append(p.queue.Pending, job)
+	p.save()
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// jobs returns a copy of the queue
+func (p *postProcessor) jobs() postProcessQueue {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return postProcessQueue{
+		Pending: append([]postProcessJob{}, p.queue.Pending...),
+		Failed:  append([]postProcessJob{}, p.queue.Failed...),
+	}
+}
+
+// outputs lists the MP4s in the processed and daily directories, oldest
+// first, leaving out those a queued job still reads or writes
+func (p *postProcessor) outputs() ([]segmentFile, error) {
+	var files []segmentFile
+	for _, dir := range []string{p.dir, filepath.Join(p.dir, "daily")} {
+		list, err := listSegments(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, list...)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	p.mu.Lock()
+	busy := make(map[string]bool)
+	for _, job := range p.queue.Pending {
+		busy[job.Input] = true
+		busy[job.Output] = true
+	}
+	p.mu.Unlock()
+
+	idle := files[:0]
+	for _, f := range files {
+		if !busy[f.path] {
+			idle = append(idle, f)
+		}
+	}
+	return idle, nil
+}
+
+// save writes the queue atomically. The caller must hold p.mu.
+func (p *postProcessor) save() {
+	p.updateMetrics()
+	data, err := json.MarshalIndent(p.queue, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode post-processing queue: %v", err)
+		return
+	}
+	path := filepath.Join(p.dir, postProcessJobsFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("Failed to write post-processing queue: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Failed to write post-processing queue: %v", err)
+	}
+}
+
+func (p *postProcessor) updateMetrics() {
+	postProcessPending.Set(int64(len(p.queue.Pending)))
+	postProcessFailed.Set(int64(len(p.queue.Failed)))
+}
+
+// run works through the queue in order, waiting for segments to settle.
+// Failed jobs are retried in place so later segments are never appended to
+// a daily file before earlier ones. It returns once ctx is cancelled,
+// leaving an interrupted job queued for the next start.
+func (p *postProcessor) run(ctx context.Context) {
+	defer close(p.done)
+	for {
+		p.mu.Lock()
+		var job postProcessJob
+		ready := len(p.queue.Pending) > 0
+		if ready {
+			job = p.queue.Pending[0]
+		}
+		p.mu.Unlock()
+
+		if ready && job.Kind == jobMP4 {
+			if info, err := os.Stat(job.Input); err == nil && time.Since(info.ModTime()) < postProcessSettle {
+				ready = false
+			}
+		}
+		if !ready {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake:
+			case <-time.After(postProcessSettle):
+			}
+			continue
+		}
+
+		next, err := p.process(ctx, &job)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// The follow-up job replaces this one in a single save, so a
+		// restart never runs a step twice
+		p.mu.Lock()
+		var retryIn time.Duration
+		switch {
+		case err == nil:
+			p.queue.Pending = p.queue.Pending[1:]
+			if next != nil {
+				next.Created = time.Now()
+				p.queue.Pending = append(p.queue.Pending, *next)
+			}
+		case os.IsNotExist(err):
+			// Retention removed the input first; nothing left to do
+			log.Printf("Post-processing: %s of %s dropped: %v", job.Kind, job.Segment, err)
+			p.queue.Pending = p.queue.Pending[1:]
+		default:
+			job.Attempts++
+			job.Error = err.Error()
+			if job.Attempts < postProcessAttempts {
+				retryIn = postProcessRetryDelay * time.Duration(job.Attempts)
+				log.Printf("Post-processing: %s of %s failed, will retry in %s: %v", job.Kind, job.Segment, retryIn, err)
+				p.queue.Pending[0] = job
+			} else {
+				log.Printf("Post-processing: %s of %s failed, giving up: %v", job.Kind, job.Segment, err)
+				p.queue.Pending = p.queue.Pending[1:]
+				p.queue.Failed = append(p.queue.Failed, job)
+				if len(p.queue.Failed) > maxFailedJobs {
+					p.queue.Failed = p.queue.Failed[len(p.queue.Failed)-maxFailedJobs:]
+				}
+			}
+		}
+		p.save()
+		p.mu.Unlock()
+
+		if retryIn > 0 {
+			timer := time.NewTimer(retryIn)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// wait blocks until run has returned after its context was cancelled
+func (p *postProcessor) wait() {
+	<-p.done
+}
+
+// process runs one job and returns the step to follow it, if any: the
+// daily concatenation after an MP4 is written, when enabled
+func (p *postProcessor) process(ctx context.Context, job *postProcessJob) (*postProcessJob, error) {
+	switch job.Kind {
+	case jobMP4:
+		if err := p.writeMP4(ctx, job.Input, job.Output); err != nil {
+			return nil, err
+		}
+		log.Printf("Post-processing: wrote %s", filepath.Base(job.Output))
+		if !p.steps.daily {
+			return nil, nil
+		}
+		return &postProcessJob{
+			Kind:    jobDaily,
+			Segment: job.Segment,
+			Input:   job.Output,
+			Output:  filepath.Join(p.dir, "daily", p.day(job.Segment)+".mp4"),
+		}, nil
+	case jobDaily:
+		if err := p.appendDaily(ctx, job); err != nil {
+			return nil, err
+		}
+		log.Printf("Post-processing: appended %s to %s", job.Segment, filepath.Base(job.Output))
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown job kind %q", job.Kind)
+}
+
+// writeMP4 copies a segment's streams into MP4, or re-encodes them to
+// H.264 when a bitrate is set or the codec cannot be carried in MP4, such
+// as GNOME Shell's VP8
+func (p *postProcessor) writeMP4(ctx context.Context, input, output string) error {
+	if _, err := os.Stat(input); err != nil {
+		return err
+	}
+	tmp := output + ".tmp"
+	defer os.Remove(tmp)
+
+	transcode := []string{"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p"}
+	if p.steps.bitrate != "" {
+		transcode = append(transcode, "-b:v", p.steps.bitrate)
+	} else {
+		transcode = append(transcode, "-crf", "23")
+	}
+
+	// Segments carry no audio
+	args := []string{"-loglevel", "error", "-i", input, "-an"}
+	if p.steps.bitrate == "" {
+		err := runFFmpeg(ctx, append(args, "-c", "copy", "-movflags", "+faststart", "-f", "mp4", "-y", tmp)...)
+		if err == nil {
+			return os.Rename(tmp, output)
+		}
+	}
+	args = append(args, transcode...)
+	if err := runFFmpeg(ctx, append(args, "-movflags", "+faststart", "-f", "mp4", "-y", tmp)...); err != nil {
+		return err
+	}
+	return os.Rename(tmp, output)
+}
+
+// appendDaily concatenates a processed segment onto the end of its day's
+// file and removes it. The result is written next to the daily file and the
+// job marked staged before it replaces it, so a restart finishes moving it
+// into place rather than appending the segment again. A segment whose file
+// is gone was already appended.
+func (p *postProcessor) appendDaily(ctx context.Context, job *postProcessJob) error {
+	if !job.Staged {
+		if _, err := os.Stat(job.Input); err != nil {
+			return err
+		}
+		daily, err := dailyFile(job.Output, job.Input)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(daily); os.IsNotExist(err) {
+			return os.Rename(job.Input, daily)
+		}
+
+		list := daily + ".txt"
+		quote := func(path string) string { return strings.ReplaceAll(path, "'", `'\''`) }
+		if err := os.WriteFile(list, []byte(fmt.Sprintf("file '%s'\nfile '%s'\n", quote(daily), quote(job.Input))), 0o600); err != nil {
+			return err
+		}
+		defer os.Remove(list)
+
+		tmp := daily + ".tmp"
+		err = runFFmpeg(ctx, "-loglevel", "error", "-f", "concat", "-safe", "0", "-i", list,
+			"-c", "copy", "-movflags", "+faststart", "-f", "mp4", "-y", tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		job.Output, job.Staged = daily, true
+		p.mu.Lock()
+		p.queue.Pending[0] = *job
+		p.save()
+		p.mu.Unlock()
+	}
+
+	// Without the staged file it was moved into place before a restart
+	tmp := job.Output + ".tmp"
+	if _, err := os.Stat(tmp); err == nil {
+		if err := os.Rename(tmp, job.Output); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(job.Input); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// dailyFile picks the daily file a part is appended to. Streams of
+// different sizes cannot be concatenated without re-encoding, so a part
+// that differs from the day's latest file, as after a capture target
+// change, starts the next one: YYYY-MM-DD-2.mp4 and so on.
+func dailyFile(first, part string) (string, error) {
+	base := strings.TrimSuffix(first, ".mp4")
+	latest, n := first, 1
+	for {
+		next := fmt.Sprintf("%s-%d.mp4", base, n+1)
+		if _, err := os.Stat(next); err != nil {
+			break
+		}
+		latest, n = next, n+1
+	}
+	if _, err := os.Stat(latest); os.IsNotExist(err) {
+		return latest, nil
+	}
+
+	have, err := mp4VideoSize(latest)
+	if err != nil {
+		return "", err
+	}
+	want, err := mp4VideoSize(part)
+	if err != nil {
+		return "", err
+	}
+	if have == want {
+		return latest, nil
+	}
+	return fmt.Sprintf("%s-%d.mp4", base, n+1), nil
+}
+
+// day names the local date a segment was recorded on
+func (p *postProcessor) day(segment string) string {
+	if info, ok := p.catalogue.lookup(segment); ok {
+		return info.Start.Local().Format("2006-01-02")
+	}
+	return time.Now().Format("2006-01-02")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Recorder is a screen capture backend that records the desktop into
+// a sequence of video segments
+type Recorder interface {
+	// Start begins recording the capture target into a new segment at
+	// filename and returns the filename the backend is writing to, if it
+	// reports one
+	Start(ctx context.Context, filename string, target captureTarget) (string, error)
+
+	// Stop ends the oldest segment still being recorded
+	Stop(ctx context.Context) error
+
+	// Overlaps reports whether a segment can be started while the previous
+	// one is still being recorded, so rotation leaves no gap
+	Overlaps() bool
+
+	// Health returns an error if the backend is no longer able to record
+	Health() error
+}
+
+// recorderConfig carries what capture backends may need
+type recorderConfig struct {
+	conn    *dbus.Conn    // session bus
+	windows windowLocator // nil when windows cannot be located
+}
+
+// recorderFactory creates a Recorder from the backend configuration
+type recorderFactory func(cfg recorderConfig) (Recorder, error)
+
+// recorderBackends maps the -backend flag values to their factories
+var recorderBackends = map[string]recorderFactory{
+	"gnome":  newGnomeRecorder,
+	"portal": newPortalRecorder,
+}
+
+// recorderBackendNames returns the registered backend names in sorted order
+func recorderBackendNames() []string {
+	names := make([]string, 0, len(recorderBackends))
+	for name := range recorderBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newRecorder creates the Recorder registered under the given backend name
+func newRecorder(backend string, cfg recorderConfig) (Recorder, error) {
+	factory, ok := recorderBackends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown capture backend %q (available: %s)",
+			backend, strings.Join(recorderBackendNames(), ", "))
+	}
+	return factory(cfg)
+}
+
+// expandTemplate substitutes the %d (date) and %t (time) placeholders of a
+// segment filename template the same way GNOME Shell does
+func expandTemplate(template string, t time.Time) string {
+	r := strings.NewReplacer(
+		"%d", t.Format("2006-01-02"),
+		"%t", t.Format("15-04-05"),
+		"%%", "%",
+	)
+	return r.Replace(template)
+}
+
+// segmentFilename expands the template for a segment starting at t. A
+// number is appended when the name is taken, as two segments can start
+// within the same second.
+func segmentFilename(template string, t time.Time) string {
+	filename := expandTemplate(template, t)
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for n := 1; ; n++ {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return filename
+		}
+		filename = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+}
+
+// checkDBusConnection verifies that the DBus connection is still alive
+// by calling the Ping method on the Peer interface
+func checkDBusConnection(conn *dbus.Conn) error {
+	// Use the Peer.Ping method which is available on all DBus connections
+	// This is a standard DBus interface for checking connection health
+	obj := conn.BusObject()
+	call := obj.Call("org.freedesktop.DBus.Peer.Ping", 0)
+	if call.Err != nil {
+		return fmt.Errorf("DBus connection lost: %w", call.Err)
+	}
+	return nil
+}
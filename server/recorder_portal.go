@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	portalDest            = "org.freedesktop.portal.Desktop"
+	portalPath            = "/org/freedesktop/portal/desktop"
+	portalScreenCastIface = "org.freedesktop.portal.ScreenCast"
+	portalRequestIface    = "org.freedesktop.portal.Request"
+	portalSessionIface    = "org.freedesktop.portal.Session"
+
+	// ScreenCast source types and persistence modes
+	portalSourceMonitor       uint32 = 1
+	portalSourceWindow        uint32 = 2
+	portalCursorEmbedded      uint32 = 2
+	portalPersistUntilRevoked uint32 = 2
+
+	// How long to wait for a portal request, including the permission dialog
+	portalRequestTimeout = 5 * time.Minute
+)
+
+// portalStream is a PipeWire stream returned by the ScreenCast portal
+type portalStream struct {
+	NodeID     uint32
+	Properties map[string]dbus.Variant
+}
+
+// portalPoint is a position or size stream property
+type portalPoint struct {
+	X, Y int32
+}
+
+// streamRect returns the stream's area in desktop coordinates, if the
+// portal reported its size
+func (s portalStream) streamRect() (image.Rectangle, bool) {
+	var pos, size portalPoint
+	v, ok := s.Properties["size"]
+	if !ok || v.Store(&size) != nil || size.X <= 0 || size.Y <= 0 {
+		return image.Rectangle{}, false
+	}
+	if v, ok := s.Properties["position"]; ok {
+		v.Store(&pos)
+	}
+	return image.Rect(int(pos.X), int(pos.Y), int(pos.X+size.X), int(pos.Y+size.Y)), true
+}
+
+// portalRecorder records segments from an xdg-desktop-portal ScreenCast
+// session by feeding its PipeWire node into a GStreamer pipeline
+type portalRecorder struct {
+	conn      *dbus.Conn
+	portal    dbus.BusObject
+	configDir string
+
+	mu         sync.Mutex
+	session    dbus.ObjectPath
+	sourceType uint32
+	stream     portalStream
+	closed     bool
+	pipelines  []*portalPipeline // oldest first
+	tokenSeq   int
+}
+
+// portalPipeline is a running gst-launch process writing one segment
+type portalPipeline struct {
+	cmd      *exec.Cmd
+	filename string
+	session  dbus.ObjectPath
+	done     chan struct{}
+	err      error
+}
+
+func newPortalRecorder(cfg recorderConfig) (Recorder, error) {
+	conn := cfg.conn
+	if _, err := exec.LookPath("gst-launch-1.0"); err != nil {
+		return nil, fmt.Errorf("portal backend requires gst-launch-1.0 with the PipeWire plugin: %w", err)
+	}
+	if !conn.SupportsUnixFDs() {
+		return nil, fmt.Errorf("session bus connection does not support file descriptor passing")
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("locate config directory: %w", err)
+	}
+
+	p := &portalRecorder{
+		conn:      conn,
+		portal:    conn.Object(portalDest, dbus.ObjectPath(portalPath)),
+		configDir: filepath.Join(configDir, "snoopy"),
+	}
+	if err := p.openSession(portalSourceMonitor); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// openSession negotiates a ScreenCast session for a monitor or a window
+// with the portal, reusing the persisted restore token for that source type
+// so permission is only requested once
+func (p *portalRecorder) openSession(sourceType uint32) error {
+	results, err := p.request(portalScreenCastIface+".CreateSession", map[string]dbus.Variant{
+		"session_handle_token": dbus.MakeVariant(p.nextToken()),
+	})
+	if err != nil {
+		return fmt.Errorf("create portal session: %w", err)
+	}
+	var sessionHandle string
+	if v, ok := results["session_handle"]; ok {
+		sessionHandle, _ = v.Value().(string)
+	}
+	if sessionHandle == "" {
+		return fmt.Errorf("create portal session: no session handle returned")
+	}
+	session := dbus.ObjectPath(sessionHandle)
+
+	selectOpts := map[string]dbus.Variant{
+		"types":        dbus.MakeVariant(sourceType),
+		"multiple":     dbus.MakeVariant(false),
+		"persist_mode": dbus.MakeVariant(portalPersistUntilRevoked),
+	}
+	if p.availableCursorModes()&portalCursorEmbedded != 0 {
+		selectOpts["cursor_mode"] = dbus.MakeVariant(portalCursorEmbedded)
+	}
+	if token := p.loadRestoreToken(sourceType); token != "" {
+		selectOpts["restore_token"] = dbus.MakeVariant(token)
+	}
+	if _, err := p.request(portalScreenCastIface+".SelectSources", selectOpts, session); err != nil {
+		return fmt.Errorf("select portal sources: %w", err)
+	}
+
+	results, err = p.request(portalScreenCastIface+".Start", map[string]dbus.Variant{}, session, "")
+	if err != nil {
+		return fmt.Errorf("start portal session: %w", err)
+	}
+
+	var streams []portalStream
+	if v, ok := results["streams"]; ok {
+		if err := v.Store(&streams); err != nil {
+			return fmt.Errorf("decode portal streams: %w", err)
+		}
+	}
+	if len(streams) == 0 {
+		return fmt.Errorf("portal did not return any PipeWire streams")
+	}
+
+	if v, ok := results["restore_token"]; ok {
+		if token, _ := v.Value().(string); token != "" {
+			p.saveRestoreToken(sourceType, token)
+		}
+	}
+
+	p.mu.Lock()
+	p.session = session
+	p.sourceType = sourceType
+	p.stream = streams[0]
+	p.closed = false
+	p.mu.Unlock()
+
+	p.watchSession(session)
+
+	log.Printf("Portal: screencast session started on PipeWire node %d", streams[0].NodeID)
+	return nil
+}
+
+// request calls a portal method that returns a Request handle and waits for
+// the Response signal, returning its results
+func (p *portalRecorder) request(method string, options map[string]dbus.Variant, args ...interface{}) (map[string]dbus.Variant, error) {
+	token := p.nextToken()
+	options["handle_token"] = dbus.MakeVariant(token)
+
+	// Subscribe before calling so the Response cannot be missed
+	handle := p.requestPath(token)
+	if err := p.conn.AddMatchSignal(responseMatch(handle)...); err != nil {
+		return nil, fmt.Errorf("subscribe to portal response: %w", err)
+	}
+	defer p.conn.RemoveMatchSignal(responseMatch(handle)...)
+
+	signals := make(chan *dbus.Signal, 4)
+	p.conn.Signal(signals)
+	defer p.conn.RemoveSignal(signals)
+
+	callArgs := append(args, options)
+	var returned dbus.ObjectPath
+	if err := p.portal.Call(method, 0, callArgs...).Store(&returned); err != nil {
+		return nil, err
+	}
+	// Older portals return a handle that differs from the predicted one
+	if returned != handle {
+		handle = returned
+		p.conn.AddMatchSignal(responseMatch(handle)...)
+		defer p.conn.RemoveMatchSignal(responseMatch(handle)...)
+	}
+
+	timeout := time.After(portalRequestTimeout)
+	for {
+		select {
+		case sig := <-signals:
+			if sig.Path != handle || sig.Name != portalRequestIface+".Response" {
+				continue
+			}
+			var response uint32
+			var results map[string]dbus.Variant
+			if err := dbus.Store(sig.Body, &response, &results); err != nil {
+				return nil, fmt.Errorf("decode portal response: %w", err)
+			}
+			switch response {
+			case 0:
+				return results, nil
+			case 1:
+				return nil, fmt.Errorf("request cancelled by user")
+			default:
+				return nil, fmt.Errorf("request failed (response %d)", response)
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for portal response")
+		}
+	}
+}
+
+// responseMatch matches the Response signal of a portal Request
+func responseMatch(handle dbus.ObjectPath) []dbus.MatchOption {
+	return []dbus.MatchOption{
+		dbus.WithMatchObjectPath(handle),
+		dbus.WithMatchInterface(portalRequestIface),
+		dbus.WithMatchMember("Response"),
+	}
+}
+
+// requestPath predicts the Request object path for a handle token
+func (p *portalRecorder) requestPath(token string) dbus.ObjectPath {
+	sender := strings.ReplaceAll(strings.TrimPrefix(p.conn.Names()[0], ":"), ".", "_")
+	return dbus.ObjectPath(fmt.Sprintf("%s/request/%s/%s", portalPath, sender, token))
+}
+
+func (p *portalRecorder) nextToken() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokenSeq++
+	return fmt.Sprintf("snoopy%d_%d", os.Getpid(), p.tokenSeq)
+}
+
+// availableCursorModes reads the AvailableCursorModes portal property
+func (p *portalRecorder) availableCursorModes() uint32 {
+	v, err := p.portal.GetProperty(portalScreenCastIface + ".AvailableCursorModes")
+	if err != nil {
+		return 0
+	}
+	modes, _ := v.Value().(uint32)
+	return modes
+}
+
+// watchSession marks the session closed when the portal revokes it
+func (p *portalRecorder) watchSession(session dbus.ObjectPath) {
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(session),
+		dbus.WithMatchInterface(portalSessionIface),
+		dbus.WithMatchMember("Closed"),
+	}
+	if err := p.conn.AddMatchSignal(match...); err != nil {
+		log.Printf("Portal: failed to watch session: %v", err)
+		return
+	}
+
+	signals := make(chan *dbus.Signal, 4)
+	p.conn.Signal(signals)
+
+	go func() {
+		defer p.conn.RemoveSignal(signals)
+		defer p.conn.RemoveMatchSignal(match...)
+		for sig := range signals {
+			if sig.Path != session || sig.Name != portalSessionIface+".Closed" {
+				continue
+			}
+			log.Printf("Portal: screencast session closed")
+			p.mu.Lock()
+			p.closed = true
+			p.mu.Unlock()
+			return
+		}
+	}()
+}
+
+// tokenPath returns where the restore token for a source type is kept;
+// monitor and window permissions are granted separately
+func (p *portalRecorder) tokenPath(sourceType uint32) string {
+	if sourceType == portalSourceWindow {
+		return filepath.Join(p.configDir, "portal-restore-token-window")
+	}
+	return filepath.Join(p.configDir, "portal-restore-token")
+}
+
+// closeSession ends a portal session that is no longer recorded from
+func (p *portalRecorder) closeSession(session dbus.ObjectPath) {
+	obj := p.conn.Object(portalDest, session)
+	if err := obj.Call(portalSessionIface+".Close", 0).Err; err != nil {
+		log.Printf("Portal: failed to close session: %v", err)
+	}
+}
+
+// loadRestoreToken returns the persisted portal restore token, if any
+func (p *portalRecorder) loadRestoreToken(sourceType uint32) string {
+	data, err := os.ReadFile(p.tokenPath(sourceType))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveRestoreToken persists the restore token for the next session
+func (p *portalRecorder) saveRestoreToken(sourceType uint32, token string) {
+	if err := os.MkdirAll(p.configDir, 0o700); err != nil {
+		log.Printf("Portal: failed to save restore token: %v", err)
+		return
+	}
+	if err := os.WriteFile(p.tokenPath(sourceType), []byte(token+"\n"), 0o600); err != nil {
+		log.Printf("Portal: failed to save restore token: %v", err)
+	}
+}
+
+// Start launches a GStreamer pipeline recording the PipeWire node into a
+// new segment. The previous segment keeps recording until Stop is called.
+// Window targets are recorded from a window session, where the window is
+// picked in the portal's dialog; regions are cropped out of the monitor.
+func (p *portalRecorder) Start(ctx context.Context, filename string, target captureTarget) (string, error) {
+	sourceType := portalSourceMonitor
+	if target.Mode == targetWindow {
+		sourceType = portalSourceWindow
+	}
+
+	p.mu.Lock()
+	closed, previous := p.closed, p.session
+	reopen := closed || p.sourceType != sourceType
+	p.mu.Unlock()
+	if reopen {
+		// The session was revoked or records the wrong kind of source;
+		// negotiate a new one with the saved token
+		if sourceType == portalSourceWindow {
+			log.Printf("Portal: choose the window for %s in the screencast dialog", target)
+		}
+		if err := p.openSession(sourceType); err != nil {
+			return "", err
+		}
+		if !closed && !p.recordingFrom(previous) {
+			p.closeSession(previous)
+		}
+	}
+
+	p.mu.Lock()
+	session, stream := p.session, p.stream
+	p.mu.Unlock()
+
+	source := []string{"pipewiresrc", "fd=3", fmt.Sprintf("path=%d", stream.NodeID), "do-timestamp=true", "keepalive-time=1000"}
+	if target.Mode == targetRegion {
+		crop, err := regionCrop(stream, target.Region.rect())
+		if err != nil {
+			return "", err
+		}
+		source = append(source, crop...)
+	}
+
+	// Each pipeline needs its own connection to the PipeWire daemon
+	var fd dbus.UnixFD
+	err := p.portal.CallWithContext(ctx, portalScreenCastIface+".OpenPipeWireRemote", 0,
+		session, map[string]dbus.Variant{}).Store(&fd)
+	if err != nil {
+		return "", fmt.Errorf("open PipeWire remote: %w", err)
+	}
+	remote := os.NewFile(uintptr(fd), "pipewire-remote")
+	defer remote.Close()
+
+	args := append([]string{"-e", "-q"}, source...)
+	args = append(args,
+		"!", "videoconvert",
+		"!", "queue",
+		"!", "vp8enc", "cpu-used=16", "deadline=1", "keyframe-max-dist=150",
+		"!", "queue",
+		"!", "webmmux",
+		"!", "filesink", "location="+filename,
+	)
+	cmd := exec.Command("gst-launch-1.0", args...)
+	cmd.ExtraFiles = []*os.File{remote}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("start gst-launch-1.0: %w", err)
+	}
+
+	pl := &portalPipeline{cmd: cmd, filename: filename, session: session, done: make(chan struct{})}
+	go func() {
+		pl.err = cmd.Wait()
+		close(pl.done)
+	}()
+
+	p.mu.Lock()
+	p.pipelines = append(p.pipelines, pl)
+	p.mu.Unlock()
+
+	return filename, nil
+}
+
+// Stop ends the oldest running segment, letting GStreamer finalise the file
+func (p *portalRecorder) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	if len(p.pipelines) == 0 {
+		p.mu.Unlock()
+		return fmt.Errorf("no recording in progress")
+	}
+	pl := p.pipelines[0]
+	p.pipelines = p.pipelines[1:]
+	// Close a session left behind by a target change once its last
+	// segment ends
+	stale := pl.session != p.session && !p.closed
+	p.mu.Unlock()
+	if stale && !p.recordingFrom(pl.session) {
+		defer p.closeSession(pl.session)
+	}
+
+	// gst-launch -e turns SIGINT into an end-of-stream so webmmux can
+	// write its cues before exiting
+	if err := pl.cmd.Process.Signal(syscall.SIGINT); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("signal gst-launch-1.0: %w", err)
+	}
+
+	select {
+	case <-pl.done:
+		return nil
+	case <-ctx.Done():
+		pl.cmd.Process.Kill()
+		return ctx.Err()
+	case <-time.After(10 * time.Second):
+		pl.cmd.Process.Kill()
+		<-pl.done
+		return fmt.Errorf("gst-launch-1.0 did not finish %s, killed", filepath.Base(pl.filename))
+	}
+}
+
+// recordingFrom reports whether a pipeline still records from a session
+func (p *portalRecorder) recordingFrom(session dbus.ObjectPath) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pl := range p.pipelines {
+		if pl.session == session {
+			return true
+		}
+	}
+	return false
+}
+
+// regionCrop returns videocrop pipeline elements cutting a desktop region
+// out of a monitor stream
+func regionCrop(stream portalStream, region image.Rectangle) ([]string, error) {
+	area, ok := stream.streamRect()
+	if !ok {
+		return nil, fmt.Errorf("portal did not report the stream size needed to crop a region")
+	}
+	r := region.Intersect(area)
+	if r.Empty() {
+		return nil, fmt.Errorf("region %v lies outside the recorded monitor %v", region, area)
+	}
+	return []string{"!", "videocrop",
+		fmt.Sprintf("left=%d", r.Min.X-area.Min.X),
+		fmt.Sprintf("top=%d", r.Min.Y-area.Min.Y),
+		fmt.Sprintf("right=%d", area.Max.X-r.Max.X),
+		fmt.Sprintf("bottom=%d", area.Max.Y-r.Max.Y),
+	}, nil
+}
+
+// Overlaps is true: each segment has its own pipeline on the same stream
+func (p *portalRecorder) Overlaps() bool {
+	return true
+}
+
+// Health checks the bus connection, the portal session and that the
+// newest pipeline is still running
+func (p *portalRecorder) Health() error {
+	if err := checkDBusConnection(p.conn); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return fmt.Errorf("portal screencast session closed")
+	}
+	if n := len(p.pipelines); n > 0 {
+		pl := p.pipelines[n-1]
+		select {
+		case <-pl.done:
+			return fmt.Errorf("gst-launch-1.0 exited while recording %s: %v", filepath.Base(pl.filename), pl.err)
+		default:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/image/draw"
+)
+
+// Redacted areas are blurred by scaling them down by this factor and back up
+const redactBlurFactor = 24
+
+// Redaction fills
+const (
+	redactFillBlack = "black"
+	redactFillBlur  = "blur"
+)
+
+// redactionRules is the JSON file given with -redact, for example
+//
+//	{
+//	  "regions": [{"x": 0, "y": 1040, "width": 1920, "height": 40}],
+//	  "windows": ["KeePassXC", "Signal"],
+//	  "blur_when_locked": true,
+//	  "fill": "blur"
+//	}
+type redactionRules struct {
+	Regions        []captureRegion `json:"regions"`          // desktop areas that are always hidden
+	Windows        []string        `json:"windows"`          // hide windows whose title contains any of these
+	BlurWhenLocked bool            `json:"blur_when_locked"` // blur the whole frame while the screen is locked
+	Fill           string          `json:"fill"`             // how regions and windows are hidden: black (default) or blur
+}
+
+// redactor hides parts of frames before they are stored or served
+type redactor struct {
+	rules   redactionRules
+	windows windowLocator
+	lock    *screenLock
+}
+
+// loadRedactor reads redaction rules from a JSON file. Rules that cannot be
+// honoured in this session are an error rather than being skipped.
+func loadRedactor(path string, windows windowLocator, conn *dbus.Conn) (*redactor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read redaction rules: %w", err)
+	}
+	var rules redactionRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse redaction rules %s: %w", path, err)
+	}
+
+	switch rules.Fill {
+	case "":
+		rules.Fill = redactFillBlack
+	case redactFillBlack, redactFillBlur:
+	default:
+		return nil, fmt.Errorf("unknown redaction fill %q (available: %s, %s)", rules.Fill, redactFillBlack, redactFillBlur)
+	}
+	for _, r := range rules.Regions {
+		if r.Width <= 0 || r.Height <= 0 {
+			return nil, fmt.Errorf("redaction region %d,%d %dx%d must have positive width and height", r.X, r.Y, r.Width, r.Height)
+		}
+	}
+	for _, title := range rules.Windows {
+		if title == "" {
+			return nil, fmt.Errorf("redaction window titles must not be empty")
+		}
+	}
+
+	r := &redactor{rules: rules}
+	if len(rules.Windows) > 0 {
+		if windows == nil {
+			return nil, fmt.Errorf("window redaction needs window lookup, which is not available in this session")
+		}
+		if waylandSession() {
+			// Only Xwayland windows could be found; native ones would be
+			// published unredacted
+			return nil, fmt.Errorf("window redaction cannot find native Wayland windows; use regions or an X11 session")
+		}
+		r.windows = windows
+	}
+	if rules.BlurWhenLocked {
+		r.lock, err = newScreenLock(conn)
+		if err != nil {
+			return nil, fmt.Errorf("blur when locked: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// apply returns the frame with the configured areas hidden. area is the
+// part of the desktop the frame shows. A nil redactor returns the frame
+// unchanged.
+func (r *redactor) apply(img image.Image, area image.Rectangle) (image.Image, error) {
+	if r == nil {
+		return img, nil
+	}
+
+	if r.lock != nil {
+		locked, err := r.lock.locked()
+		if err != nil {
+			// Fail closed when the lock state is unknown
+			log.Printf("Failed to read screen lock state, blurring frame: %v", err)
+		}
+		if locked || err != nil {
+			return blurImage(img), nil
+		}
+	}
+
+	var hidden []image.Rectangle
+	for _, region := range r.rules.Regions {
+		hidden = append(hidden, region.rect())
+	}
+	for _, title := range r.rules.Windows {
+		wins, err := r.windows.FindWindows(title)
+		if err != nil {
+			return nil, fmt.Errorf("locate windows %q to redact: %w", title, err)
+		}
+		hidden = append(hidden, wins...)
+	}
+
+	return r.hide(img, area, hidden), nil
+}
+
+// hidesTitle reports whether a window title matches a window rule, so it
+// must not be published either
+func (r *redactor) hidesTitle(title string) bool {
+	if r == nil {
+		return false
+	}
+	title = strings.ToLower(title)
+	for _, rule := range r.rules.Windows {
+		if strings.Contains(title, strings.ToLower(rule)) {
+			return true
+		}
+	}
+	return false
+}
+
+// errRedactRecorded is returned when a frame from a recording cannot be
+// redacted
+var errRedactRecorded = errors.New("redaction rules cannot be applied to recorded frames")
+
+// applyRecorded hides the configured regions in a frame extracted from a
+// recording of the given desktop area. Where windows were when it was
+// recorded is not known, so window rules make it fail rather than return
+// the frame unredacted.
+func (r *redactor) applyRecorded(img image.Image, area image.Rectangle) (image.Image, error) {
+	if r == nil {
+		return img, nil
+	}
+	if len(r.rules.Windows) > 0 {
+		return nil, fmt.Errorf("%w: window rules need the window positions at the time", errRedactRecorded)
+	}
+	var hidden []image.Rectangle
+	for _, region := range r.rules.Regions {
+		hidden = append(hidden, region.rect())
+	}
+	return r.hide(img, area, hidden), nil
+}
+
+// hide fills the given desktop rectangles of a frame showing area
+func (r *redactor) hide(img image.Image, area image.Rectangle, hidden []image.Rectangle) image.Image {
+	if len(hidden) == 0 {
+		return img
+	}
+
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+	for _, h := range hidden {
+		rect := desktopToFrame(h, area, b)
+		if rect.Empty() {
+			continue
+		}
+		if r.rules.Fill == redactFillBlur {
+			blurred := blurImage(out.SubImage(rect))
+			draw.Draw(out, rect, blurred, rect.Min, draw.Src)
+		} else {
+			draw.Draw(out, rect, image.Black, image.Point{}, draw.Src)
+		}
+	}
+	return out
+}
+
+// blurImage returns a heavily blurred copy of an image, too coarse to read
+// text from
+func blurImage(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx()/redactBlurFactor, b.Dy()/redactBlurFactor
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	small := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, b, draw.Src, nil)
+	out := image.NewRGBA(b)
+	draw.BiLinear.Scale(out, b, small, small.Bounds(), draw.Src, nil)
+	return out
+}
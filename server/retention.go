@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often the janitor applies the retention policy
+const janitorInterval = time.Minute
+
+// imageRetention limits how long and how much the image cache keeps, on
+// top of the per-output image count
+type imageRetention struct {
+	maxAge   time.Duration // 0 for no age limit
+	maxBytes int64         // total size of images and derivatives, 0 for no limit
+}
+
+func (p imageRetention) enabled() bool {
+	return p.maxAge > 0 || p.maxBytes > 0
+}
+
+// runJanitor applies the retention policy now and then periodically
+func (ic *ImageCache) runJanitor(policy imageRetention) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		ic.applyRetention(policy, time.Now())
+		<-ticker.C
+	}
+}
+
+// applyRetention removes images older than the maximum age, then the
+// oldest images until the cache fits its byte budget. The newest image of
+// each output is always kept so viewers of a static screen still see it.
+func (ic *ImageCache) applyRetention(policy imageRetention, now time.Time) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	newest := make(map[string]string)
+	for _, img := range ic.images {
+		newest[img.Output] = img.Name
+	}
+
+	var total int64
+	sizes := make([]int64, len(ic.images))
+	if policy.maxBytes > 0 {
+		for i, img := range ic.images {
+			sizes[i] = ic.diskUsage(img)
+			total += sizes[i]
+		}
+	}
+
+	removed := 0
+	kept := ic.images[:0]
+	for i, img := range ic.images {
+		expired := policy.maxAge > 0 && now.Sub(img.Captured) > policy.maxAge
+		overBudget := policy.maxBytes > 0 && total > policy.maxBytes
+		if (expired || overBudget) && newest[img.Output] != img.Name {
+			ic.removeFiles(img)
+			total -= sizes[i]
+			removed++
+			continue
+		}
+		kept = append(kept, img)
+	}
+	ic.images = kept
+
+	if removed > 0 {
+		ic.saveIndex()
+		log.Printf("Image cache: retention removed %d images", removed)
+	}
+}
+
+// diskUsage returns the size of an image and its derivatives on disk. The
+// caller must hold ic.mu.
+func (ic *ImageCache) diskUsage(img cachedImage) int64 {
+	size := img.Bytes
+	for _, d := range img.Derivatives {
+		if info, err := os.Stat(filepath.Join(ic.dir, d)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
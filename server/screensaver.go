@@ -0,0 +1,158 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Lock state, served at /debug/vars
+var screenLockedFlag = expvar.NewInt("screen_locked")
+
+// screenSaverService is a D-Bus screen saver interface reporting whether
+// the session is locked
+type screenSaverService struct {
+	dest  string
+	path  string
+	iface string
+}
+
+// GNOME Shell implements its own interface; KDE and most others implement
+// the freedesktop one
+var screenSaverServices = []screenSaverService{
+	{"org.gnome.ScreenSaver", "/org/gnome/ScreenSaver", "org.gnome.ScreenSaver"},
+	{"org.freedesktop.ScreenSaver", "/org/freedesktop/ScreenSaver", "org.freedesktop.ScreenSaver"},
+}
+
+// screenLock queries the session's screen saver for the lock state
+type screenLock struct {
+	obj     dbus.BusObject
+	service screenSaverService
+}
+
+// newScreenLock finds a screen saver service that answers GetActive
+func newScreenLock(conn *dbus.Conn) (*screenLock, error) {
+	for _, svc := range screenSaverServices {
+		l := &screenLock{obj: conn.Object(svc.dest, dbus.ObjectPath(svc.path)), service: svc}
+		if _, err := l.locked(); err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no screen saver service on the session bus")
+}
+
+// locked reports whether the screen saver, and with it the lock screen,
+// is active
+func (l *screenLock) locked() (bool, error) {
+	var active bool
+	if err := l.obj.Call(l.service.iface+".GetActive", 0).Store(&active); err != nil {
+		return false, fmt.Errorf("query %s: %w", l.service.dest, err)
+	}
+	return active, nil
+}
+
+// lockWatcher follows the session's lock state through the screen saver's
+// ActiveChanged signal and logind's session lock hint. The session counts
+// as locked while any of them says so.
+type lockWatcher struct {
+	// changes receives the new state whenever it changes
+	changes chan bool
+
+	mu      sync.Mutex
+	sources map[string]bool // lock state reported by each source
+	locked  bool
+}
+
+// newLockWatcher subscribes to every lock source that can be found on the
+// session and system buses
+func newLockWatcher(conn *dbus.Conn) (*lockWatcher, error) {
+	w := &lockWatcher{changes: make(chan bool, 1), sources: make(map[string]bool)}
+
+	watching := false
+	if lock, err := newScreenLock(conn); err == nil {
+		if err := w.watchScreenSaver(conn, lock); err != nil {
+			log.Printf("Screen saver signals unavailable: %v", err)
+		} else {
+			watching = true
+		}
+	}
+	if err := w.watchLogind(); err != nil {
+		log.Printf("logind lock hint unavailable: %v", err)
+	} else {
+		watching = true
+	}
+	if !watching {
+		return nil, fmt.Errorf("no screen saver or logind session to watch")
+	}
+	return w, nil
+}
+
+// watchScreenSaver follows the ActiveChanged signal of the screen saver
+func (w *lockWatcher) watchScreenSaver(conn *dbus.Conn, lock *screenLock) error {
+	iface := lock.service.iface
+	if err := conn.AddMatchSignal(dbus.WithMatchInterface(iface), dbus.WithMatchMember("ActiveChanged")); err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 8)
+	conn.Signal(signals)
+
+	active, err := lock.locked()
+	if err != nil {
+		return err
+	}
+	w.update(lock.service.dest, active)
+
+	go func() {
+		for sig := range signals {
+			if sig.Name != iface+".ActiveChanged" || len(sig.Body) != 1 {
+				continue
+			}
+			if active, ok := sig.Body[0].(bool); ok {
+				w.update(lock.service.dest, active)
+			}
+		}
+	}()
+	return nil
+}
+
+// update records the state reported by a source and announces a change
+// of the combined state
+func (w *lockWatcher) update(source string, locked bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sources[source] = locked
+
+	combined := false
+	for _, l := range w.sources {
+		combined = combined || l
+	}
+	if combined == w.locked {
+		return
+	}
+	w.locked = combined
+	if combined {
+		screenLockedFlag.Set(1)
+	} else {
+		screenLockedFlag.Set(0)
+	}
+	// Replace a state the main loop has not picked up yet
+	select {
+	case <-w.changes:
+	default:
+	}
+	w.changes <- combined
+}
+
+// isLocked reports whether the session is locked; false when locks are
+// not watched
+func (w *lockWatcher) isLocked() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.locked
+}
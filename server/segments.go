@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// segmentFile is a recorded segment in the output directory
+type segmentFile struct {
+	name    string
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// listSegments returns the video files in a directory, oldest first by
+// modification time
+func listSegments(dir string) ([]segmentFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segmentFile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		// Look for video files (mp4 or webm)
+		ext := filepath.Ext(name)
+		if ext != ".mp4" && ext != ".webm" {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segmentFile{
+			name:    name,
+			path:    filepath.Join(dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].modTime.Before(segments[j].modTime)
+	})
+	return segments, nil
+}
+
+// segmentTracker remembers the segment currently being recorded so
+// captured images can be traced back to it
+type segmentTracker struct {
+	mu      sync.RWMutex
+	name    string
+	started time.Time
+}
+
+// start records that a new segment began
+func (t *segmentTracker) start(filename string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.name = filepath.Base(filename)
+	t.started = at
+}
+
+// current returns the name of the segment being recorded, if any
+func (t *segmentTracker) current() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.name
+}
+
+// at returns the segment being recorded at a moment and how far into it
+// the moment lies
+func (t *segmentTracker) at(moment time.Time) (string, time.Duration, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.name == "" || moment.Before(t.started) {
+		return "", 0, false
+	}
+	return t.name, moment.Sub(t.started), true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A moment this close to a segment still snaps to its first or last frame,
+// which covers the pause between segments
+const frameSeekSlack = 5 * time.Second
+
+// errNoRecording is returned when no segment covers a moment
+var errNoRecording = errors.New("no recording at that time")
+
+// segmentInfo describes a recorded segment in the /api/segments response
+type segmentInfo struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Duration  float64   `json:"duration"` // seconds
+	Bytes     int64     `json:"bytes"`
+	Recording bool      `json:"recording,omitempty"` // still being written
+	Integrity string    `json:"integrity,omitempty"` // "repaired" or "damaged" when found incomplete
+	Problem   string    `json:"problem,omitempty"`   // what was wrong with it
+}
+
+// segmentCatalogue describes the segments in the output directory. Parsed
+// WebM headers are cached until a file changes; only headers are read, so
+// describing the growing segment stays cheap.
+type segmentCatalogue struct {
+	dir      string
+	segments *segmentTracker
+	journal  *segmentJournal
+
+	mu     sync.Mutex
+	parsed map[string]catalogueEntry
+}
+
+type catalogueEntry struct {
+	size    int64
+	modTime time.Time
+	info    segmentInfo
+}
+
+func newSegmentCatalogue(dir string, segments *segmentTracker, journal *segmentJournal) *segmentCatalogue {
+	return &segmentCatalogue{dir: dir, segments: segments, journal: journal, parsed: make(map[string]catalogueEntry)}
+}
+
+// list describes every segment, oldest first
+func (c *segmentCatalogue) list() ([]segmentInfo, error) {
+	files, err := listSegments(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := c.segments.current()
+	seen := make(map[string]bool)
+	infos := make([]segmentInfo, 0, len(files))
+	for _, f := range files {
+		seen[f.name] = true
+		infos = append(infos, c.info(f, current))
+	}
+	for name := range c.parsed {
+		if !seen[name] {
+			delete(c.parsed, name)
+		}
+	}
+	return infos, nil
+}
+
+// lookup describes one segment by file name
+func (c *segmentCatalogue) lookup(name string) (segmentInfo, bool) {
+	if name != filepath.Base(name) {
+		return segmentInfo{}, false
+	}
+	if ext := filepath.Ext(name); ext != ".webm" && ext != ".mp4" {
+		return segmentInfo{}, false
+	}
+	st, err := os.Stat(c.path(name))
+	if err != nil || st.IsDir() {
+		return segmentInfo{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := segmentFile{name: name, path: c.path(name), size: st.Size(), modTime: st.ModTime()}
+	return c.info(f, c.segments.current()), true
+}
+
+// info describes a segment from the cache, parsing it again if it changed.
+// The segment being recorded ends now. The caller must hold c.mu.
+func (c *segmentCatalogue) info(f segmentFile, current string) segmentInfo {
+	entry, ok := c.parsed[f.name]
+	if !ok || entry.size != f.size || !entry.modTime.Equal(f.modTime) {
+		entry = catalogueEntry{size: f.size, modTime: f.modTime, info: c.describe(f)}
+		c.parsed[f.name] = entry
+	}
+	info := entry.info
+	if f.name == current {
+		info.Recording = true
+		if now := time.Now().UTC(); now.After(info.Start) {
+			info.End = now
+			info.Duration = info.End.Sub(info.Start).Seconds()
+		}
+	}
+	info.Integrity, info.Problem = c.journal.integrity(f.name)
+	return info
+}
+
+// path returns the file path of a segment
+func (c *segmentCatalogue) path(name string) string {
+	return filepath.Join(c.dir, filepath.Base(name))
+}
+
+// describe works out when a segment was recorded. Finished WebM files carry
+// their creation date and duration in the header. Otherwise the segment
+// journal says when it started and stopped, or it is assumed to end at its
+// modification time.
+func (c *segmentCatalogue) describe(f segmentFile) segmentInfo {
+	info := segmentInfo{Name: f.name, URL: "/segments/" + f.name, Bytes: f.size, End: f.modTime.UTC()}
+
+	var duration time.Duration
+	var start time.Time
+	if filepath.Ext(f.name) == ".webm" {
+		if w, err := readWebMHeader(f.path); err == nil {
+			duration = w.duration
+			start = w.dateUTC
+		}
+	}
+	started, stopped := c.journal.span(f.name)
+	if start.IsZero() {
+		start = started
+	}
+	if duration == 0 && !start.IsZero() && stopped.After(start) {
+		duration = stopped.Sub(start)
+	}
+	if start.IsZero() {
+		start = f.modTime.Add(-duration)
+	}
+	info.Start = start.UTC()
+	if duration > 0 {
+		info.End = info.Start.Add(duration)
+	}
+	info.Duration = info.End.Sub(info.Start).Seconds()
+	return info
+}
+
+// covering returns the segment recorded at a moment and the offset of the
+// moment into it. Moments just outside a segment are clamped to it.
+func (c *segmentCatalogue) covering(at time.Time) (segmentInfo, time.Duration, error) {
+	infos, err := c.list()
+	if err != nil {
+		return segmentInfo{}, 0, err
+	}
+
+	var best segmentInfo
+	bestDistance := frameSeekSlack + 1
+	for _, info := range infos {
+		var distance time.Duration
+		switch {
+		case at.Before(info.Start):
+			distance = info.Start.Sub(at)
+		case at.After(info.End):
+			distance = at.Sub(info.End)
+		}
+		if distance < bestDistance {
+			best, bestDistance = info, distance
+		}
+	}
+	if bestDistance > frameSeekSlack {
+		return segmentInfo{}, 0, errNoRecording
+	}
+
+	offset := at.Sub(best.Start)
+	// Seeking to the very end finds no frame, so stay a second short of it
+	duration := best.End.Sub(best.Start)
+	if offset > duration-time.Second {
+		offset = duration - time.Second
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return best, offset, nil
+}
+
+// frameAt extracts the frame on screen at a moment from the segment
+// recorded then
+func (c *segmentCatalogue) frameAt(ctx context.Context, at time.Time) (image.Image, segmentInfo, error) {
+	info, offset, err := c.covering(at)
+	if err != nil {
+		return nil, segmentInfo{}, err
+	}
+	seek := strconv.FormatFloat(offset.Seconds(), 'f', 3, 64)
+	img, err := extractFrame(ctx, c.path(info.Name), "-ss", seek)
+	if err != nil {
+		return nil, segmentInfo{}, fmt.Errorf("frame at %s: %w", at.Format(time.RFC3339), err)
+	}
+	return img, info, nil
+}
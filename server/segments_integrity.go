@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Integrity scan metrics, served at /debug/vars
+var (
+	segmentsRepaired = expvar.NewInt("segments_repaired")
+	segmentsDamaged  = expvar.NewInt("segments_damaged")
+)
+
+// errUnrepairable marks problems a remux cannot fix
+var errUnrepairable = errors.New("cannot be repaired")
+
+// scanSegments checks the segments left by previous runs, which may have
+// been cut off when snoopy was killed, and remuxes those whose container
+// metadata is incomplete. Results, complete segments included, are
+// recorded in the journal, so each segment is only checked once. files must
+// be listed before recording starts so the segment being written is never
+// touched.
+func scanSegments(files []segmentFile, journal *segmentJournal) {
+	_, lookErr := exec.LookPath("ffmpeg")
+	for _, f := range files {
+		if journal.checked(f.name) {
+			continue
+		}
+		if _, err := os.Stat(f.path); os.IsNotExist(err) {
+			// Removed by retention since it was listed
+			continue
+		}
+		problem, err := segmentProblem(f)
+		if problem == "" {
+			journal.noteIntegrity(f.name, journalChecked, "", nil)
+			continue
+		}
+		if err == nil && lookErr != nil {
+			// Left unrecorded so it is repaired once ffmpeg is installed
+			log.Printf("Segment %s is %s; install ffmpeg to repair it", f.name, problem)
+			continue
+		}
+		if err == nil {
+			log.Printf("Segment %s is %s, repairing", f.name, problem)
+			err = repairSegment(context.Background(), f)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("Segment %s was removed while being repaired", f.name)
+			continue
+		}
+		if err != nil {
+			log.Printf("Segment %s is %s and was flagged as damaged: %v", f.name, problem, err)
+			journal.noteIntegrity(f.name, journalDamaged, problem, err)
+			segmentsDamaged.Add(1)
+			continue
+		}
+		log.Printf("Repaired segment %s", f.name)
+		journal.noteIntegrity(f.name, journalRepaired, problem, nil)
+		segmentsRepaired.Add(1)
+	}
+}
+
+// segmentProblem describes what is wrong with a segment's container, or
+// returns "" for a complete file. The error is errUnrepairable when a
+// remux would not help.
+func segmentProblem(f segmentFile) (string, error) {
+	if filepath.Ext(f.name) == ".mp4" {
+		ok, err := mp4HasMovie(f.path)
+		if err != nil {
+			return "unreadable", err
+		}
+		if !ok {
+			// The sample tables are written last; without them the
+			// frames cannot be located
+			return "missing its moov box", errUnrepairable
+		}
+		return "", nil
+	}
+
+	w, err := openWebM(f.path)
+	if err != nil {
+		// ffmpeg may still salvage the clusters
+		return "unreadable", nil
+	}
+	switch {
+	case w.lastKeyframe == nil:
+		return "without video frames", errUnrepairable
+	case w.truncated:
+		return "truncated", nil
+	case w.duration == 0:
+		return "missing its duration", nil
+	case !w.hasCues:
+		return "missing its cues", nil
+	}
+	return "", nil
+}
+
+// repairSegment remuxes a segment with ffmpeg, which rewrites the duration
+// and cues and drops a partial final cluster. The repaired file keeps the
+// original modification time so retention and the catalogue still see it
+// at the same place in the recording.
+func repairSegment(ctx context.Context, f segmentFile) error {
+	tmp := f.path + ".repair"
+	defer os.Remove(tmp)
+
+	err := runFFmpeg(ctx, "-loglevel", "error", "-i", f.path, "-c", "copy", "-f", "webm", "-y", tmp)
+	if err != nil {
+		return err
+	}
+	repaired := segmentFile{name: f.name, path: tmp}
+	if problem, _ := segmentProblem(repaired); problem != "" {
+		return fmt.Errorf("still %s after remuxing", problem)
+	}
+	if err := os.Chtimes(tmp, f.modTime, f.modTime); err != nil {
+		return err
+	}
+	// Retention may have removed the segment meanwhile; do not bring it back
+	if _, err := os.Stat(f.path); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// mp4HasMovie reports whether an MP4 file has its moov box
+func mp4HasMovie(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	_, _, ok, err := mp4Box(f, 0, info.Size(), "moov")
+	return ok, err
+}
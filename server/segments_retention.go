@@ -0,0 +1,203 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Segments modified this recently may still be written to and are never
+// removed
+const segmentActiveWindow = 2 * time.Minute
+
+// Segment retention metrics, served at /debug/vars
+var (
+	segmentsPurged       = expvar.NewInt("segments_purged")
+	segmentBytesPurged   = expvar.NewInt("segment_bytes_purged")
+	segmentsOnDisk       = expvar.NewInt("segments_on_disk")
+	segmentBytesOnDisk   = expvar.NewInt("segment_bytes_on_disk")
+	videoDiskFreeBytes   = expvar.NewInt("video_disk_free_bytes")
+	recordingPausedFlag  = expvar.NewInt("recording_paused")
+	processedPurged      = expvar.NewInt("processed_purged")
+	processedBytesOnDisk = expvar.NewInt("processed_bytes_on_disk")
+)
+
+// segmentRetention limits the recorded segments kept in the output
+// directory
+type segmentRetention struct {
+	keep     int           // newest segments to keep, 0 for no limit
+	maxAge   time.Duration // 0 for no age limit
+	maxBytes int64         // total size of segments, 0 for no limit
+	minFree  int64         // free space below which recording pauses, 0 to never pause
+
+	processedMaxBytes int64 // total size of post-processed output, 0 for no limit
+}
+
+// segmentJanitor enforces segment retention and watches free disk space
+type segmentJanitor struct {
+	dir      string
+	policy   segmentRetention
+	segments *segmentTracker
+	post     *postProcessor // nil when post-processing is off
+
+	// lowSpace receives true when free space drops below the watermark
+	// and false once it recovers
+	lowSpace chan bool
+	low      bool
+}
+
+func newSegmentJanitor(dir string, policy segmentRetention, segments *segmentTracker, post *postProcessor) *segmentJanitor {
+	return &segmentJanitor{
+		dir:      dir,
+		policy:   policy,
+		segments: segments,
+		post:     post,
+		lowSpace: make(chan bool, 1),
+	}
+}
+
+// run applies the retention policy now and then periodically
+func (j *segmentJanitor) run() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		if err := j.sweep(time.Now()); err != nil {
+			log.Printf("Segment retention failed: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// sweep removes segments beyond the count, age and size limits, oldest
+// first, prunes the processed output, then checks the free space watermark
+// so whatever was freed counts towards it
+func (j *segmentJanitor) sweep(now time.Time) error {
+	segments, err := listSegments(j.dir)
+	if err != nil {
+		return fmt.Errorf("list segments: %w", err)
+	}
+
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+
+	current := j.segments.current()
+	count := len(segments)
+	var purged int
+	for _, seg := range segments {
+		// Never touch segments that are still being recorded
+		if seg.name == current || now.Sub(seg.modTime) < segmentActiveWindow {
+			continue
+		}
+
+		var reason string
+		switch {
+		case j.policy.keep > 0 && count > j.policy.keep:
+			reason = fmt.Sprintf("more than %d segments", j.policy.keep)
+		case j.policy.maxAge > 0 && now.Sub(seg.modTime) > j.policy.maxAge:
+			reason = fmt.Sprintf("older than %s", j.policy.maxAge)
+		case j.policy.maxBytes > 0 && total > j.policy.maxBytes:
+			reason = fmt.Sprintf("segments exceed %d bytes", j.policy.maxBytes)
+		default:
+			continue
+		}
+
+		if err := os.Remove(seg.path); err != nil {
+			log.Printf("Failed to remove segment %s: %v", seg.name, err)
+			continue
+		}
+		log.Printf("Removed segment %s (%d bytes): %s", seg.name, seg.size, reason)
+		count--
+		total -= seg.size
+		purged++
+		segmentsPurged.Add(1)
+		segmentBytesPurged.Add(seg.size)
+	}
+	segmentsOnDisk.Set(int64(count))
+	segmentBytesOnDisk.Set(total)
+
+	if j.post != nil {
+		if err := j.sweepProcessed(now); err != nil {
+			log.Printf("Processed output retention failed: %v", err)
+		}
+	}
+
+	free, err := diskFree(j.dir)
+	if err != nil {
+		return fmt.Errorf("check free space: %w", err)
+	}
+	videoDiskFreeBytes.Set(free)
+	if j.policy.minFree > 0 {
+		// Resume only with some headroom so recording does not flap
+		low := free < j.policy.minFree
+		if j.low {
+			low = free < j.policy.minFree+j.policy.minFree/10
+		}
+		if low != j.low {
+			j.low = low
+			// Replace a state the main loop has not picked up yet
+			select {
+			case <-j.lowSpace:
+			default:
+			}
+			j.lowSpace <- low
+		}
+	}
+	return nil
+}
+
+// sweepProcessed removes post-processed MP4s and daily files older than the
+// segment age limit, then the oldest beyond the processed size limit. Files
+// a queued job still uses or that were written recently are kept.
+func (j *segmentJanitor) sweepProcessed(now time.Time) error {
+	files, err := j.post.outputs()
+	if err != nil {
+		return fmt.Errorf("list processed output: %w", err)
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	for _, f := range files {
+		if now.Sub(f.modTime) < segmentActiveWindow {
+			continue
+		}
+
+		var reason string
+		switch {
+		case j.policy.maxAge > 0 && now.Sub(f.modTime) > j.policy.maxAge:
+			reason = fmt.Sprintf("older than %s", j.policy.maxAge)
+		case j.policy.processedMaxBytes > 0 && total > j.policy.processedMaxBytes:
+			reason = fmt.Sprintf("processed output exceeds %d bytes", j.policy.processedMaxBytes)
+		default:
+			continue
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Failed to remove processed %s: %v", f.name, err)
+			continue
+		}
+		log.Printf("Removed processed %s (%d bytes): %s", f.name, f.size, reason)
+		total -= f.size
+		processedPurged.Add(1)
+	}
+	processedBytesOnDisk.Set(total)
+	return nil
+}
+
+// diskFree returns the bytes available to unprivileged users on the file
+// system holding dir
+func diskFree(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
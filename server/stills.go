@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// FrameSource grabs still frames of the screen for web streaming
+type FrameSource interface {
+	// Grab returns the most recent frame of the screen
+	Grab(ctx context.Context) (image.Image, error)
+}
+
+// segmentChecker is implemented by frame sources that can only read some of
+// the segments a backend may record
+type segmentChecker interface {
+	// checkSegment returns an error when frames cannot be read from the
+	// segment being recorded
+	checkSegment(ctx context.Context, path string) error
+}
+
+// stillsConfig carries the settings frame sources may need
+type stillsConfig struct {
+	videoDir string
+	interval time.Duration
+	conn     *dbus.Conn // session bus
+}
+
+// frameSourceFactory creates a FrameSource from the stills configuration
+type frameSourceFactory func(cfg stillsConfig) (FrameSource, error)
+
+// frameSources maps the -stills flag values to their factories
+var frameSources = map[string]frameSourceFactory{
+	"ffmpeg-pipe":      newPipeFrameSource,
+	"gnome-screenshot": newGnomeScreenshotSource,
+	"video":            newVideoFrameSource,
+	"webm":             newWebMFrameSource,
+	"x11":              newX11FrameSource,
+}
+
+// screenFrameSources grab the live screen rather than reading recorded
+// segments, so their frames are cropped to the capture target
+var screenFrameSources = map[string]bool{
+	"gnome-screenshot": true,
+	"x11":              true,
+}
+
+// frameSourceNames returns the registered frame source names in sorted order
+func frameSourceNames() []string {
+	names := make([]string, 0, len(frameSources))
+	for name := range frameSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newFrameSource creates the FrameSource registered under the given name
+func newFrameSource(name string, cfg stillsConfig) (FrameSource, error) {
+	factory, ok := frameSources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown stills source %q (available: %s)",
+			name, strings.Join(frameSourceNames(), ", "))
+	}
+	return factory(cfg)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	screenshotDest   = "org.gnome.Shell.Screenshot"
+	screenshotPath   = "/org/gnome/Shell/Screenshot"
+	screenshotIface  = "org.gnome.Shell.Screenshot"
+	screenshotMethod = screenshotIface + ".Screenshot"
+)
+
+// errScreenshotDenied is returned when GNOME Shell only lets allow-listed
+// callers take screenshots, as GNOME 41 and later do
+var errScreenshotDenied = errors.New("GNOME Shell denied screenshot access")
+
+// gnomeScreenshotSource grabs frames through GNOME Shell's Screenshot
+// D-Bus API, independently of any segment recording
+type gnomeScreenshotSource struct {
+	obj dbus.BusObject
+}
+
+func newGnomeScreenshotSource(cfg stillsConfig) (FrameSource, error) {
+	if cfg.conn == nil {
+		return nil, fmt.Errorf("gnome-screenshot source requires the session bus")
+	}
+	g := &gnomeScreenshotSource{
+		obj: cfg.conn.Object(screenshotDest, dbus.ObjectPath(screenshotPath)),
+	}
+
+	// A denied caller is denied for good, so find out before streaming
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := g.Grab(ctx); errors.Is(err, errScreenshotDenied) {
+		return nil, fmt.Errorf("%w; GNOME 41 and later only allow allow-listed callers, use -stills video or x11", err)
+	}
+	return g, nil
+}
+
+// Grab asks GNOME Shell to write a screenshot to a temporary PNG file
+func (g *gnomeScreenshotSource) Grab(ctx context.Context) (image.Image, error) {
+	tmp, err := os.CreateTemp("", "snoopy-screenshot-*.png")
+	if err != nil {
+		return nil, fmt.Errorf("create screenshot file: %w", err)
+	}
+	tmpFile := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpFile)
+
+	var success bool
+	var filename string
+	err = g.obj.CallWithContext(ctx, screenshotMethod, 0,
+		false, // include cursor
+		false, // flash
+		tmpFile,
+	).Store(&success, &filename)
+	if err != nil {
+		// GNOME 41+ only allows allow-listed callers to take screenshots
+		if dbusErr, ok := err.(dbus.Error); ok && dbusErr.Name == "org.freedesktop.DBus.Error.AccessDenied" {
+			return nil, fmt.Errorf("%w: %v", errScreenshotDenied, err)
+		}
+		return nil, fmt.Errorf("take screenshot: %w", err)
+	}
+	if !success {
+		return nil, fmt.Errorf("GNOME Shell failed to take screenshot")
+	}
+	if filename != "" && filename != tmpFile {
+		defer os.Remove(filename)
+	} else {
+		filename = tmpFile
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read screenshot: %w", err)
+	}
+	defer f.Close()
+
+	return png.Decode(f)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the tailer polls a segment for appended data
+	pipeTailPoll = 250 * time.Millisecond
+
+	// Largest JPEG frame accepted from ffmpeg
+	pipeMaxFrameSize = 32 * 1024 * 1024
+)
+
+// pipeFrameSource keeps a single ffmpeg process per segment that decodes
+// the growing file as it is written and emits MJPEG frames on stdout
+type pipeFrameSource struct {
+	videoDir string
+	interval time.Duration
+
+	mu   sync.Mutex
+	pipe *ffmpegPipe
+}
+
+// ffmpegPipe is an ffmpeg child tailing one segment
+type ffmpegPipe struct {
+	path   string
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	latest []byte // most recent JPEG frame
+	err    error
+}
+
+func newPipeFrameSource(cfg stillsConfig) (FrameSource, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, fmt.Errorf("ffmpeg not found in PATH: %w", err)
+	}
+	return &pipeFrameSource{videoDir: cfg.videoDir, interval: cfg.interval}, nil
+}
+
+// Grab returns the latest frame emitted by the pipeline for the newest
+// segment, restarting the pipeline when a new segment appears
+func (p *pipeFrameSource) Grab(ctx context.Context) (image.Image, error) {
+	videoFile, err := findMostRecentVideo(p.videoDir)
+	if err != nil {
+		return nil, fmt.Errorf("find recent video: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pipe != nil {
+		select {
+		case <-p.pipe.done:
+			log.Printf("ffmpeg pipeline for %s exited: %v", filepath.Base(p.pipe.path), p.pipe.error())
+			p.pipe = nil
+		default:
+			if p.pipe.path != videoFile {
+				p.pipe.stop()
+				p.pipe = nil
+			}
+		}
+	}
+	if p.pipe == nil {
+		pipe, err := startFFmpegPipe(videoFile, p.interval)
+		if err != nil {
+			return nil, err
+		}
+		p.pipe = pipe
+		log.Printf("Started ffmpeg pipeline for %s", filepath.Base(videoFile))
+	}
+
+	frame := p.pipe.frame()
+	if frame == nil {
+		return nil, fmt.Errorf("waiting for first frame from %s", filepath.Base(videoFile))
+	}
+	return jpeg.Decode(bytes.NewReader(frame))
+}
+
+// startFFmpegPipe launches ffmpeg reading the segment from stdin
+func startFFmpegPipe(path string, interval time.Duration) (*ffmpegPipe, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Feed the header followed by the cluster holding the latest keyframe,
+	// so a long segment does not have to be decoded from the start
+	var input io.Reader = &tailReader{ctx: ctx, f: f}
+	if webm, err := openWebM(path); err == nil && webm.lastKeyframe != nil {
+		input = io.MultiReader(
+			io.NewSectionReader(f, 0, webm.firstCluster),
+			&tailReader{ctx: ctx, f: f, offset: webm.lastKeyframe.clusterOffset},
+		)
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-loglevel", "error",
+		"-f", "matroska",
+		"-i", "pipe:0",
+		"-an",
+		"-vf", fmt.Sprintf("fps=%g", 1/interval.Seconds()),
+		"-c:v", "mjpeg",
+		"-q:v", "2",
+		"-flush_packets", "1",
+		"-f", "image2pipe",
+		"pipe:1",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		f.Close()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		f.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		f.Close()
+		return nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+
+	pipe := &ffmpegPipe{path: path, cancel: cancel, done: make(chan struct{})}
+
+	// Copy the growing file into ffmpeg until the pipeline is stopped
+	go func() {
+		defer f.Close()
+		defer stdin.Close()
+		io.Copy(stdin, input)
+	}()
+
+	// Split stdout into JPEG frames, keeping only the newest
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 1024*1024), pipeMaxFrameSize)
+		scanner.Split(splitJPEG)
+		for scanner.Scan() {
+			frame := make([]byte, len(scanner.Bytes()))
+			copy(frame, scanner.Bytes())
+			pipe.mu.Lock()
+			pipe.latest = frame
+			pipe.mu.Unlock()
+		}
+
+		err := cmd.Wait()
+		if err != nil && stderr.Len() > 0 {
+			err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		pipe.mu.Lock()
+		pipe.err = err
+		pipe.mu.Unlock()
+		close(pipe.done)
+	}()
+
+	return pipe, nil
+}
+
+// frame returns the newest JPEG emitted, or nil before the first one
+func (p *ffmpegPipe) frame() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latest
+}
+
+func (p *ffmpegPipe) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// stop terminates ffmpeg and the tailer
+func (p *ffmpegPipe) stop() {
+	p.cancel()
+	<-p.done
+}
+
+// splitJPEG is a bufio.SplitFunc that returns complete JPEG images
+// delimited by their SOI and EOI markers
+func splitJPEG(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.Index(data, []byte{0xFF, 0xD8})
+	if start < 0 {
+		// Keep a trailing 0xFF in case it begins a marker
+		if len(data) > 0 && data[len(data)-1] == 0xFF {
+			return len(data) - 1, nil, nil
+		}
+		return len(data), nil, nil
+	}
+	end := bytes.Index(data[start+2:], []byte{0xFF, 0xD9})
+	if end < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		// Request more data, discarding anything before the frame
+		return start, nil, nil
+	}
+	end += start + 4
+	return end, data[start:end], nil
+}
+
+// tailReader reads a file that is still being written, waiting for more
+// data at EOF instead of returning it until its context is cancelled
+type tailReader struct {
+	ctx    context.Context
+	f      *os.File
+	offset int64
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.f.ReadAt(p, t.offset)
+		t.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		select {
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		case <-time.After(pipeTailPoll):
+		}
+	}
+}
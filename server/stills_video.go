@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// videoFrameSource extracts frames from the most recent recorded segment
+// using ffmpeg
+type videoFrameSource struct {
+	videoDir string
+}
+
+func newVideoFrameSource(cfg stillsConfig) (FrameSource, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, fmt.Errorf("ffmpeg not found in PATH: %w", err)
+	}
+	return &videoFrameSource{videoDir: cfg.videoDir}, nil
+}
+
+// Grab extracts a frame from near the end of the newest segment
+func (v *videoFrameSource) Grab(ctx context.Context) (image.Image, error) {
+	// Find the most recent video file
+	videoFile, err := findMostRecentVideo(v.videoDir)
+	if err != nil {
+		return nil, fmt.Errorf("find recent video: %w", err)
+	}
+
+	// Use -sseof to seek from the end, getting a recent frame
+	return extractFrame(ctx, videoFile, "-sseof", "-3") // 3 seconds before end of file
+}
+
+// extractFrame decodes one frame of a video file with ffmpeg, seeking with
+// the given input options first
+func extractFrame(ctx context.Context, videoFile string, seek ...string) (image.Image, error) {
+	// Create temp file for frame extraction; frames are extracted concurrently
+	tmp, err := os.CreateTemp("", "snoopy-frame-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	tmpFile := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpFile)
+
+	args := []string{"-loglevel", "error"} // Only show errors
+	args = append(args, seek...)
+	args = append(args,
+		"-i", videoFile,
+		"-frames:v", "1", // Extract 1 frame
+		"-q:v", "2", // JPEG quality (2 is high quality)
+		"-y", // Overwrite output file
+		tmpFile,
+	)
+	if err := runFFmpeg(ctx, args...); err != nil {
+		return nil, fmt.Errorf("extract frame from %s: %w", filepath.Base(videoFile), err)
+	}
+
+	// Read the frame file
+	f, err := os.Open(tmpFile)
+	if err != nil {
+		return nil, fmt.Errorf("read extracted frame: %w", err)
+	}
+	defer f.Close()
+
+	return jpeg.Decode(f)
+}
+
+// runFFmpeg runs ffmpeg, including its error output in the error
+func runFFmpeg(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	// Capture stderr for error messages
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+	return nil
+}
+
+func findMostRecentVideo(dir string) (string, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("no video files found in %s", dir)
+	}
+	return segments[len(segments)-1].path, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// webmCheckTimeout bounds how long the startup check waits for the first
+// segment header to be written
+const webmCheckTimeout = 10 * time.Second
+
+// webmFrameSource decodes the latest keyframe of the newest segment in
+// process, without spawning ffmpeg. Only VP8 is decoded; recording any
+// other codec with this source is refused.
+type webmFrameSource struct {
+	videoDir string
+
+	mu   sync.Mutex
+	file *webmFile
+}
+
+func newWebMFrameSource(cfg stillsConfig) (FrameSource, error) {
+	return &webmFrameSource{videoDir: cfg.videoDir}, nil
+}
+
+// Grab decodes the most recent keyframe written to the newest segment
+func (w *webmFrameSource) Grab(ctx context.Context) (image.Image, error) {
+	videoFile, err := findMostRecentVideo(w.videoDir)
+	if err != nil {
+		return nil, fmt.Errorf("find recent video: %w", err)
+	}
+	if filepath.Ext(videoFile) != ".webm" {
+		return nil, fmt.Errorf("%s is not a webm file, use -stills video", filepath.Base(videoFile))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Parse new segments from the start, otherwise only read what was appended
+	if w.file == nil || w.file.path != videoFile {
+		file, err := openWebM(videoFile)
+		if err != nil {
+			if errors.Is(err, errWebMIncomplete) {
+				return nil, fmt.Errorf("%s: no frames written yet", filepath.Base(videoFile))
+			}
+			return nil, fmt.Errorf("parse %s: %w", filepath.Base(videoFile), err)
+		}
+		w.file = file
+		if file.codecID == "V_VP8" {
+			log.Printf("Decoding stills from %s (%s, %dx%d)", filepath.Base(videoFile), file.codecID, file.width, file.height)
+		}
+	} else if err := w.file.scan(); err != nil {
+		w.file = nil
+		return nil, fmt.Errorf("scan %s: %w", filepath.Base(videoFile), err)
+	}
+
+	if w.file.codecID != "V_VP8" {
+		return nil, fmt.Errorf("%s is %s, only V_VP8 is decoded, use -stills video", filepath.Base(videoFile), w.file.codecID)
+	}
+	return w.file.decodeLatestKeyframe()
+}
+
+// checkSegment waits for the segment header and refuses anything but VP8
+// WebM, so a backend recording another codec is caught at startup
+func (w *webmFrameSource) checkSegment(ctx context.Context, path string) error {
+	if filepath.Ext(path) != ".webm" {
+		return fmt.Errorf("%s is not a webm file", filepath.Base(path))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webmCheckTimeout)
+	defer cancel()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		header, err := readWebMHeader(path)
+		switch {
+		case err == nil && header.codecID == "V_VP8":
+			return nil
+		case err == nil:
+			return fmt.Errorf("%s is %s, only V_VP8 is decoded", filepath.Base(path), header.codecID)
+		case !errors.Is(err, errWebMIncomplete) && !errors.Is(err, fs.ErrNotExist):
+			return fmt.Errorf("parse %s: %w", filepath.Base(path), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			// Nothing written yet; Grab reports the codec once it is known
+			log.Printf("No header in %s after %s, codec not checked", filepath.Base(path), webmCheckTimeout)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
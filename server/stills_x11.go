@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/randr"
+	"github.com/jezek/xgb/shm"
+	"github.com/jezek/xgb/xproto"
+	"golang.org/x/sys/unix"
+)
+
+// x11FrameSource grabs the root window directly over the X protocol,
+// using MIT-SHM when the server supports it
+type x11FrameSource struct {
+	mu       sync.Mutex
+	conn     *xgb.Conn
+	root     xproto.Window
+	bpp      int
+	useShm   bool
+	useRandR bool
+
+	// Shared memory segment, sized for the current screen
+	shmSeg  shm.Seg
+	shmData []byte
+}
+
+func newX11FrameSource(cfg stillsConfig) (FrameSource, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, fmt.Errorf("connect to X server: %w", err)
+	}
+
+	setup := xproto.Setup(conn)
+	screen := setup.DefaultScreen(conn)
+	if setup.ImageByteOrder != xproto.ImageOrderLSBFirst {
+		conn.Close()
+		return nil, fmt.Errorf("unsupported X image byte order")
+	}
+
+	bpp := 0
+	for _, format := range setup.PixmapFormats {
+		if format.Depth == screen.RootDepth {
+			bpp = int(format.BitsPerPixel)
+		}
+	}
+	if bpp != 32 {
+		conn.Close()
+		return nil, fmt.Errorf("unsupported root window format: depth %d, %d bits per pixel", screen.RootDepth, bpp)
+	}
+
+	x := &x11FrameSource{
+		conn: conn,
+		root: screen.Root,
+		bpp:  bpp,
+	}
+	if err := shm.Init(conn); err != nil {
+		log.Printf("X11: MIT-SHM unavailable, using GetImage: %v", err)
+	} else {
+		x.useShm = true
+	}
+	if err := randr.Init(conn); err != nil {
+		log.Printf("X11: RandR unavailable, monitors cannot be enumerated: %v", err)
+	} else {
+		x.useRandR = true
+	}
+
+	return x, nil
+}
+
+// Grab captures the full root window
+func (x *x11FrameSource) Grab(ctx context.Context) (image.Image, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	// The root window size changes when outputs are reconfigured
+	geom, err := xproto.GetGeometry(x.conn, xproto.Drawable(x.root)).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("get root geometry: %w", err)
+	}
+	return x.grabRect(image.Rect(0, 0, int(geom.Width), int(geom.Height)))
+}
+
+// Outputs lists the active RandR monitors
+func (x *x11FrameSource) Outputs() ([]displayOutput, error) {
+	if !x.useRandR {
+		return nil, fmt.Errorf("RandR extension not available")
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	reply, err := randr.GetMonitors(x.conn, x.root, true).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("get monitors: %w", err)
+	}
+
+	outputs := make([]displayOutput, 0, len(reply.Monitors))
+	for _, m := range reply.Monitors {
+		name, err := xproto.GetAtomName(x.conn, m.Name).Reply()
+		if err != nil {
+			return nil, fmt.Errorf("get monitor name: %w", err)
+		}
+		outputs = append(outputs, displayOutput{
+			Name:    name.Name,
+			X:       int(m.X),
+			Y:       int(m.Y),
+			Width:   int(m.Width),
+			Height:  int(m.Height),
+			Primary: m.Primary,
+		})
+	}
+	return outputs, nil
+}
+
+// grabRect captures a rectangle of the root window
+func (x *x11FrameSource) grabRect(r image.Rectangle) (image.Image, error) {
+	if x.useShm {
+		img, err := x.grabShm(r)
+		if err == nil {
+			return img, nil
+		}
+		log.Printf("X11: MIT-SHM capture failed, falling back to GetImage: %v", err)
+		x.releaseShm()
+		x.useShm = false
+	}
+
+	reply, err := xproto.GetImage(x.conn, xproto.ImageFormatZPixmap, xproto.Drawable(x.root),
+		int16(r.Min.X), int16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy()), 0xffffffff).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("get image: %w", err)
+	}
+	return bgrxToRGBA(reply.Data, r.Dx(), r.Dy())
+}
+
+// grabShm captures a rectangle into the shared memory segment
+func (x *x11FrameSource) grabShm(r image.Rectangle) (image.Image, error) {
+	size := r.Dx() * r.Dy() * x.bpp / 8
+	if len(x.shmData) < size {
+		x.releaseShm()
+		if err := x.allocShm(size); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := shm.GetImage(x.conn, xproto.Drawable(x.root),
+		int16(r.Min.X), int16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy()),
+		0xffffffff, xproto.ImageFormatZPixmap, x.shmSeg, 0).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("shm get image: %w", err)
+	}
+	return bgrxToRGBA(x.shmData[:size], r.Dx(), r.Dy())
+}
+
+// allocShm creates a System V shared memory segment and attaches it to
+// both this process and the X server
+func (x *x11FrameSource) allocShm(size int) error {
+	id, err := unix.SysvShmGet(unix.IPC_PRIVATE, size, unix.IPC_CREAT|0o600)
+	if err != nil {
+		return fmt.Errorf("shmget: %w", err)
+	}
+	data, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+		return fmt.Errorf("shmat: %w", err)
+	}
+
+	seg, err := shm.NewSegId(x.conn)
+	if err == nil {
+		err = shm.AttachChecked(x.conn, seg, uint32(id), false).Check()
+	}
+	// Once the X server has attached, the segment can be marked for removal
+	// so it is freed automatically when both sides detach
+	unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+	if err != nil {
+		unix.SysvShmDetach(data)
+		return fmt.Errorf("attach shm segment: %w", err)
+	}
+
+	x.shmSeg = seg
+	x.shmData = data
+	return nil
+}
+
+// releaseShm detaches the shared memory segment, if one is allocated
+func (x *x11FrameSource) releaseShm() {
+	if x.shmData == nil {
+		return
+	}
+	shm.Detach(x.conn, x.shmSeg)
+	unix.SysvShmDetach(x.shmData)
+	x.shmData = nil
+}
+
+// bgrxToRGBA converts a 32 bits per pixel little-endian ZPixmap into an
+// RGBA image
+func bgrxToRGBA(data []byte, width, height int) (image.Image, error) {
+	if len(data) < width*height*4 {
+		return nil, fmt.Errorf("short image data: got %d bytes for %dx%d", len(data), width, height)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height*4; i += 4 {
+		img.Pix[i+0] = data[i+2]
+		img.Pix[i+1] = data[i+1]
+		img.Pix[i+2] = data[i+0]
+		img.Pix[i+3] = 0xff
+	}
+	return img, nil
+}
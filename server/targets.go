@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Capture target modes
+const (
+	targetScreen = "screen"
+	targetRegion = "region"
+	targetWindow = "window"
+)
+
+// captureRegion is a rectangle in desktop coordinates
+type captureRegion struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (r captureRegion) rect() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+// parseRegion parses a region given as "x,y,width,height"
+func parseRegion(s string) (captureRegion, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return captureRegion{}, fmt.Errorf("region %q must be x,y,width,height", s)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return captureRegion{}, fmt.Errorf("region %q: %w", s, err)
+		}
+		v[i] = n
+	}
+	return captureRegion{X: v[0], Y: v[1], Width: v[2], Height: v[3]}, nil
+}
+
+// captureTarget selects the part of the desktop that is recorded and
+// streamed
+type captureTarget struct {
+	Mode   string         `json:"mode"`
+	Region *captureRegion `json:"region,omitempty"`
+	Window string         `json:"window,omitempty"` // matched against window titles
+}
+
+// validate checks that the target has the settings its mode needs
+func (t captureTarget) validate() error {
+	switch t.Mode {
+	case targetScreen:
+		return nil
+	case targetRegion:
+		if t.Region == nil || t.Region.Width <= 0 || t.Region.Height <= 0 {
+			return fmt.Errorf("region mode needs a region with positive width and height")
+		}
+		return nil
+	case targetWindow:
+		if t.Window == "" {
+			return fmt.Errorf("window mode needs a window title")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown capture mode %q (available: %s, %s, %s)", t.Mode, targetScreen, targetRegion, targetWindow)
+}
+
+// String describes the target for log output
+func (t captureTarget) String() string {
+	switch t.Mode {
+	case targetRegion:
+		return fmt.Sprintf("region %d,%d %dx%d", t.Region.X, t.Region.Y, t.Region.Width, t.Region.Height)
+	case targetWindow:
+		return fmt.Sprintf("window %q", t.Window)
+	}
+	return "whole screen"
+}
+
+// resolve returns the target's rectangle in desktop coordinates. It
+// reports false for the whole screen.
+func (t captureTarget) resolve(windows windowLocator) (image.Rectangle, bool, error) {
+	switch t.Mode {
+	case targetRegion:
+		return t.Region.rect(), true, nil
+	case targetWindow:
+		if windows == nil {
+			return image.Rectangle{}, false, fmt.Errorf("window lookup is not available in this session")
+		}
+		r, err := windows.FindWindow(t.Window)
+		if err != nil {
+			return image.Rectangle{}, false, err
+		}
+		return r, true, nil
+	}
+	return image.Rectangle{}, false, nil
+}
+
+// targetState holds the current capture target, which can be changed at
+// runtime over HTTP
+type targetState struct {
+	mu      sync.RWMutex
+	target  captureTarget
+	changed chan struct{}
+}
+
+func newTargetState(target captureTarget) (*targetState, error) {
+	if err := target.validate(); err != nil {
+		return nil, err
+	}
+	return &targetState{target: target, changed: make(chan struct{}, 1)}, nil
+}
+
+// get returns the current target
+func (s *targetState) get() captureTarget {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.target
+}
+
+// set replaces the target and signals the change
+func (s *targetState) set(target captureTarget) error {
+	if err := target.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.target = target
+	s.mu.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// A change is already pending
+	}
+	return nil
+}
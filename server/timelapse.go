@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timelapse frame sources
+const (
+	timelapseImages   = "images"   // frames stored in the image cache
+	timelapseSegments = "segments" // frames sampled from recorded segments
+)
+
+// Most frames fed to ffmpeg for one timelapse; cached images beyond this
+// are thinned out evenly
+const maxTimelapseFrames = 20000
+
+// Bounds of the recorded time between output frames, speed/fps
+const (
+	minTimelapseStep = time.Millisecond
+	maxTimelapseStep = 24 * time.Hour
+)
+
+// timelapseFormat is an output format of a timelapse
+type timelapseFormat struct {
+	contentType string
+	codec       []string // ffmpeg output options
+}
+
+// timelapseFormats maps the timelapse formats to their encoders
+var timelapseFormats = map[string]timelapseFormat{
+	"mp4":  {"video/mp4", []string{"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart"}},
+	"webm": {"video/webm", []string{"-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "35", "-pix_fmt", "yuv420p"}},
+	"webp": {"image/webp", []string{"-c:v", "libwebp", "-loop", "0", "-quality", "75"}}, // animated
+}
+
+// timelapseFormatNames returns the timelapse formats in sorted order
+func timelapseFormatNames() []string {
+	names := make([]string, 0, len(timelapseFormats))
+	for name := range timelapseFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// timelapseSpec describes a timelapse to make
+type timelapseSpec struct {
+	from, to time.Time
+	speed    float64 // times real time
+	fps      int
+	source   string // timelapseImages or timelapseSegments
+	output   string // image stream, "" for the whole desktop
+	format   string
+}
+
+func (s timelapseSpec) validate() error {
+	switch {
+	case !s.to.After(s.from):
+		return fmt.Errorf("the end of a timelapse must be after its start")
+	case s.speed <= 0:
+		return fmt.Errorf("speed must be positive")
+	case s.fps < 1 || s.fps > 60:
+		return fmt.Errorf("fps must be between 1 and 60")
+	case s.source != timelapseImages && s.source != timelapseSegments:
+		return fmt.Errorf("unknown timelapse source %q (available: %s, %s)", s.source, timelapseImages, timelapseSegments)
+	}
+	// Checked as a float, which cannot overflow like a Duration; NaN fails too
+	if step := s.speed / float64(s.fps); !(step >= minTimelapseStep.Seconds() && step <= maxTimelapseStep.Seconds()) {
+		return fmt.Errorf("speed/fps must be between %s and %s of recording per frame", minTimelapseStep, maxTimelapseStep)
+	}
+	if _, ok := timelapseFormats[s.format]; !ok {
+		return fmt.Errorf("unknown timelapse format %q (available: %s)", s.format, strings.Join(timelapseFormatNames(), ", "))
+	}
+	return nil
+}
+
+// step is the recorded time between output frames
+func (s timelapseSpec) step() time.Duration {
+	return time.Duration(s.speed / float64(s.fps) * float64(time.Second))
+}
+
+// timelapseFrame is a still on disk and when it was on screen
+type timelapseFrame struct {
+	path string
+	at   time.Time
+}
+
+// makeTimelapse gathers the frames between the spec's times and encodes
+// them into outPath. Cached images come from images, which must be sorted
+// by capture time; segments are sampled through the catalogue.
+func makeTimelapse(ctx context.Context, spec timelapseSpec, imageDir string, images []cachedImage, catalogue *segmentCatalogue, outPath string) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	work, err := os.MkdirTemp("", "snoopy-timelapse-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	var frames []timelapseFrame
+	if spec.source == timelapseImages {
+		frames = cachedFrames(imageDir, images)
+	} else {
+		frames, err = sampleSegments(ctx, catalogue, spec, work)
+		if err != nil {
+			return err
+		}
+	}
+	if len(frames) == 0 {
+		return errNoFrames
+	}
+
+	// Cached images record their size, which Go cannot read from AVIF
+	var size image.Point
+	if spec.source == timelapseImages {
+		size = image.Pt(images[0].Width, images[0].Height)
+	}
+	if size.X == 0 || size.Y == 0 {
+		if size, err = frameSize(frames[0].path); err != nil {
+			return fmt.Errorf("read first frame: %w", err)
+		}
+	}
+	return encodeTimelapse(ctx, spec, frames, size, work, outPath)
+}
+
+// errNoFrames is returned when nothing was captured in a timelapse's span
+var errNoFrames = errors.New("no frames in that time range")
+
+// cachedFrames lists cached images as frames. Images in another format
+// than the first are skipped, as ffmpeg cannot concatenate mixed inputs.
+func cachedFrames(dir string, images []cachedImage) []timelapseFrame {
+	if len(images) > maxTimelapseFrames {
+		thinned := make([]cachedImage, 0, maxTimelapseFrames)
+		for i := 0; i < maxTimelapseFrames; i++ {
+			thinned = append(thinned, images[i*len(images)/maxTimelapseFrames])
+		}
+		images = thinned
+	}
+
+	var frames []timelapseFrame
+	for _, img := range images {
+		if len(frames) > 0 && filepath.Ext(img.Name) != filepath.Ext(frames[0].path) {
+			continue
+		}
+		frames = append(frames, timelapseFrame{path: filepath.Join(dir, img.Name), at: img.Captured})
+	}
+	return frames
+}
+
+// sampleSegments extracts a frame for every output frame of the timelapse
+// from the segments recorded in its span, one ffmpeg run per segment
+func sampleSegments(ctx context.Context, catalogue *segmentCatalogue, spec timelapseSpec, dir string) ([]timelapseFrame, error) {
+	step := spec.step()
+	if n := spec.to.Sub(spec.from) / step; n > maxTimelapseFrames {
+		return nil, fmt.Errorf("timelapse would have %d frames, more than %d; raise the speed", n, maxTimelapseFrames)
+	}
+
+	segments, err := catalogue.list()
+	if err != nil {
+		return nil, fmt.Errorf("list segments: %w", err)
+	}
+
+	var frames []timelapseFrame
+	for i, seg := range segments {
+		from, to := seg.Start, seg.End
+		if spec.from.After(from) {
+			from = spec.from
+		}
+		if spec.to.Before(to) {
+			to = spec.to
+		}
+		if !to.After(from) {
+			continue
+		}
+
+		pattern := filepath.Join(dir, fmt.Sprintf("segment%04d-%%06d.jpg", i))
+		err := runFFmpeg(ctx, "-loglevel", "error",
+			"-ss", seconds(from.Sub(seg.Start)),
+			"-i", catalogue.path(seg.Name),
+			"-t", seconds(to.Sub(from)),
+			"-vf", "fps=1/"+seconds(step),
+			"-q:v", "3",
+			"-y", pattern,
+		)
+		if err != nil {
+			// A damaged segment leaves a hole rather than failing the timelapse
+			log.Printf("Timelapse: skipping segment %s: %v", seg.Name, err)
+			continue
+		}
+
+		for n := 1; ; n++ {
+			path := fmt.Sprintf(pattern, n)
+			if _, err := os.Stat(path); err != nil {
+				break
+			}
+			frames = append(frames, timelapseFrame{path: path, at: from.Add(time.Duration(n-1) * step)})
+		}
+	}
+	return frames, nil
+}
+
+// encodeTimelapse has ffmpeg play the frames back at the spec's speed,
+// each frame shown until the next one was captured. Frames are scaled and
+// padded to size so captures of differently sized targets can be mixed.
+func encodeTimelapse(ctx context.Context, spec timelapseSpec, frames []timelapseFrame, size image.Point, dir, outPath string) error {
+	var list strings.Builder
+	for i, f := range frames {
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(f.path, "'", `'\''`))
+		duration := 1 / float64(spec.fps)
+		if i+1 < len(frames) {
+			duration = frames[i+1].at.Sub(f.at).Seconds() / spec.speed
+		}
+		fmt.Fprintf(&list, "duration %.6f\n", duration)
+	}
+	// The concat demuxer ignores the duration of the last entry
+	fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(frames[len(frames)-1].path, "'", `'\''`))
+
+	listPath := filepath.Join(dir, "frames.txt")
+	if err := os.WriteFile(listPath, []byte(list.String()), 0o600); err != nil {
+		return err
+	}
+
+	// Most encoders need even dimensions
+	w, h := size.X&^1, size.Y&^1
+	filter := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,fps=%d", w, h, w, h, spec.fps)
+	args := []string{"-loglevel", "error", "-f", "concat", "-safe", "0", "-i", listPath, "-vf", filter}
+	args = append(args, timelapseFormats[spec.format].codec...)
+	if err := runFFmpeg(ctx, append(args, "-f", spec.format, "-y", outPath)...); err != nil {
+		return fmt.Errorf("encode timelapse: %w", err)
+	}
+	return nil
+}
+
+// frameSize reads the dimensions of a still
+func frameSize(path string) (image.Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Point{}, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Point{}, err
+	}
+	return image.Pt(cfg.Width, cfg.Height), nil
+}
+
+// seconds formats a duration for ffmpeg
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// runTimelapseCommand implements "snoopy timelapse", which makes a
+// timelapse from the files a running or stopped snoopy left on disk
+func runTimelapseCommand(args []string) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("timelapse", flag.ExitOnError)
+	var (
+		from     = fs.String("from", "", "Start of the timelapse (RFC 3339)")
+		to       = fs.String("to", "", "End of the timelapse (RFC 3339, default: now)")
+		speed    = fs.Float64("speed", 60, "Playback speed as a multiple of real time")
+		fps      = fs.Int("fps", 30, "Frame rate of the timelapse")
+		source   = fs.String("source", timelapseImages, "Frames to use: "+timelapseImages+" (the image cache) or "+timelapseSegments+" (sampled from recorded video)")
+		output   = fs.String("output", "", "Monitor stream to use with -source images (default: the whole desktop)")
+		outFile  = fs.String("o", "", "File to write; the format ("+strings.Join(timelapseFormatNames(), ", ")+") follows the extension")
+		videoDir = fs.String("out", filepath.Join(home, ".cache", "snoopy", "video"), "Directory of recorded segments")
+		imageDir = fs.String("images", filepath.Join(home, ".cache", "snoopy", "images"), "Image cache directory")
+	)
+	fs.Parse(args)
+
+	if *outFile == "" {
+		return fmt.Errorf("-o is required")
+	}
+	spec := timelapseSpec{
+		speed:  *speed,
+		fps:    *fps,
+		source: *source,
+		output: *output,
+		format: strings.TrimPrefix(filepath.Ext(*outFile), "."),
+		to:     time.Now(),
+	}
+	if spec.from, err = time.Parse(time.RFC3339, *from); err != nil {
+		return fmt.Errorf("-from must be an RFC 3339 time")
+	}
+	if *to != "" {
+		if spec.to, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fmt.Errorf("-to must be an RFC 3339 time")
+		}
+	}
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	// Read what the server keeps on disk without changing it
+	var images []cachedImage
+	var catalogue *segmentCatalogue
+	if spec.source == timelapseImages {
+		all, err := readImageIndex(*imageDir)
+		if err != nil {
+			return err
+		}
+		images = imagesBetween(all, spec.output, spec.from, spec.to)
+	} else {
+		entries, _, err := readJournal(filepath.Join(*videoDir, segmentJournalFile), time.Time{})
+		if err != nil {
+			return err
+		}
+		catalogue = newSegmentCatalogue(*videoDir, &segmentTracker{}, &segmentJournal{entries: entries})
+	}
+
+	if err := makeTimelapse(context.Background(), spec, *imageDir, images, catalogue, *outFile); err != nil {
+		return err
+	}
+	log.Printf("Wrote timelapse to %s", *outFile)
+	return nil
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"golang.org/x/image/vp8"
+)
+
+// Matroska/WebM element IDs used by the demuxer
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDDocType       = 0x4282
+	mkvIDSegment        = 0x18538067
+	mkvIDSeekHead       = 0x114D9B74
+	mkvIDInfo           = 0x1549A966
+	mkvIDTimecodeScale  = 0x2AD7B1
+	mkvIDDuration       = 0x4489
+	mkvIDDateUTC        = 0x4461
+	mkvIDTracks         = 0x1654AE6B
+	mkvIDTrackEntry     = 0xAE
+	mkvIDTrackNumber    = 0xD7
+	mkvIDTrackType      = 0x83
+	mkvIDCodecID        = 0x86
+	mkvIDVideo          = 0xE0
+	mkvIDPixelWidth     = 0xB0
+	mkvIDPixelHeight    = 0xBA
+	mkvIDCluster        = 0x1F43B675
+	mkvIDClusterTime    = 0xE7
+	mkvIDSimpleBlock    = 0xA3
+	mkvIDBlockGroup     = 0xA0
+	mkvIDBlock          = 0xA1
+	mkvIDReferenceBlock = 0xFB
+	mkvIDCues           = 0x1C53BB6B
+	mkvIDChapters       = 0x1043A770
+	mkvIDTags           = 0x1254C367
+	mkvIDAttachments    = 0x1941A469
+
+	mkvTrackTypeVideo = 1
+
+	// Matroska timestamps count from this epoch
+	mkvDateEpoch = 978307200 // 2001-01-01T00:00:00Z
+)
+
+// errWebMIncomplete is returned when a file has not been written far
+// enough to contain a usable header
+var errWebMIncomplete = errors.New("incomplete webm header")
+
+// webmKeyframe locates a video keyframe within a WebM file
+type webmKeyframe struct {
+	clusterOffset int64         // offset of the enclosing Cluster element
+	offset        int64         // offset of the frame data
+	size          int64         // size of the frame data
+	timestamp     time.Duration // presentation time from segment start
+}
+
+// webmFile is the incrementally parsed structure of a WebM segment. Files
+// that are still being written can be rescanned; parsing resumes from the
+// last cluster seen so only new data is read.
+type webmFile struct {
+	path string
+
+	// Header information
+	docType       string
+	segmentOffset int64 // offset of the Segment payload
+	segmentSize   int64 // -1 while the muxer has not written it
+	timecodeScale uint64
+	duration      time.Duration // 0 when not written
+	dateUTC       time.Time
+	videoTrack    uint64
+	codecID       string
+	width         uint64
+	height        uint64
+	firstCluster  int64
+	hasCues       bool
+
+	// Scan state
+	resume       int64 // offset to resume scanning from
+	size         int64 // file size at the last scan
+	lastKeyframe *webmKeyframe
+	lastTime     time.Duration // timestamp of the last complete block
+	truncated    bool          // the last scan ended inside an element
+}
+
+// openWebM parses the header of a WebM file and scans its clusters
+func openWebM(path string) (*webmFile, error) {
+	w := &webmFile{path: path, segmentSize: -1, timecodeScale: 1000000}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	w.size = info.Size()
+
+	r := newEBMLReader(f, 0)
+	if err := w.parseHeader(r); err != nil {
+		return nil, err
+	}
+	if err := w.scanFrom(f, w.resume); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// readWebMHeader parses only the header of a WebM file, which carries its
+// creation date and, once the muxer has finished, its duration
+func readWebMHeader(path string) (*webmFile, error) {
+	w := &webmFile{path: path, segmentSize: -1, timecodeScale: 1000000}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := w.parseHeader(newEBMLReader(f, 0)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// scan reads any data appended to the file since the last scan
+func (w *webmFile) scan() error {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < w.size {
+		return fmt.Errorf("%s shrank from %d to %d bytes", w.path, w.size, info.Size())
+	}
+	w.size = info.Size()
+	return w.scanFrom(f, w.resume)
+}
+
+// parseHeader reads the EBML header and the Segment metadata up to the
+// first Cluster
+func (w *webmFile) parseHeader(r *ebmlReader) error {
+	id, size, err := r.readElementHeader()
+	if err != nil {
+		return errWebMIncomplete
+	}
+	if id != ebmlIDHeader || size < 0 {
+		return fmt.Errorf("not an EBML file")
+	}
+	end := r.pos + size
+	for r.pos < end {
+		id, size, err := r.readElementHeader()
+		if err != nil || size < 0 {
+			return errWebMIncomplete
+		}
+		if id == ebmlIDDocType {
+			b, err := r.readBytes(size)
+			if err != nil {
+				return errWebMIncomplete
+			}
+			w.docType = string(bytes.TrimRight(b, "\x00"))
+			continue
+		}
+		if err := r.skip(size); err != nil {
+			return errWebMIncomplete
+		}
+	}
+	if w.docType != "webm" && w.docType != "matroska" {
+		return fmt.Errorf("unsupported document type %q", w.docType)
+	}
+
+	id, size, err = r.readElementHeader()
+	if err != nil {
+		return errWebMIncomplete
+	}
+	if id != mkvIDSegment {
+		return fmt.Errorf("missing Segment element")
+	}
+	w.segmentOffset = r.pos
+	w.segmentSize = size
+
+	// Read top-level metadata until the first cluster
+	for {
+		start := r.pos
+		id, size, err := r.readElementHeader()
+		if err != nil {
+			return errWebMIncomplete
+		}
+		switch id {
+		case mkvIDCluster:
+			w.firstCluster = start
+			w.resume = start
+			if w.videoTrack == 0 {
+				return fmt.Errorf("no video track found")
+			}
+			return nil
+		case mkvIDInfo:
+			if size < 0 {
+				return errWebMIncomplete
+			}
+			if err := w.parseInfo(r, r.pos+size); err != nil {
+				return err
+			}
+		case mkvIDTracks:
+			if size < 0 {
+				return errWebMIncomplete
+			}
+			if err := w.parseTracks(r, r.pos+size); err != nil {
+				return err
+			}
+		default:
+			if size < 0 {
+				return fmt.Errorf("unknown-sized element 0x%X in header", id)
+			}
+			if id == mkvIDCues {
+				w.hasCues = true
+			}
+			if err := r.skip(size); err != nil {
+				return errWebMIncomplete
+			}
+		}
+	}
+}
+
+// parseInfo reads the Segment Info element
+func (w *webmFile) parseInfo(r *ebmlReader, end int64) error {
+	var duration float64
+	for r.pos < end {
+		id, size, err := r.readElementHeader()
+		if err != nil || size < 0 {
+			return errWebMIncomplete
+		}
+		b, err := r.readBytes(size)
+		if err != nil {
+			return errWebMIncomplete
+		}
+		switch id {
+		case mkvIDTimecodeScale:
+			w.timecodeScale = ebmlUint(b)
+		case mkvIDDuration:
+			duration = ebmlFloat(b)
+		case mkvIDDateUTC:
+			if len(b) == 8 {
+				ns := int64(binary.BigEndian.Uint64(b))
+				w.dateUTC = time.Unix(mkvDateEpoch, ns).UTC()
+			}
+		}
+	}
+	if duration > 0 {
+		w.duration = time.Duration(duration * float64(w.timecodeScale))
+	}
+	return nil
+}
+
+// parseTracks finds the first video track
+func (w *webmFile) parseTracks(r *ebmlReader, end int64) error {
+	for r.pos < end {
+		id, size, err := r.readElementHeader()
+		if err != nil || size < 0 {
+			return errWebMIncomplete
+		}
+		if id != mkvIDTrackEntry {
+			if err := r.skip(size); err != nil {
+				return errWebMIncomplete
+			}
+			continue
+		}
+
+		var number, trackType, width, height uint64
+		var codecID string
+		entryEnd := r.pos + size
+		for r.pos < entryEnd {
+			id, size, err := r.readElementHeader()
+			if err != nil || size < 0 {
+				return errWebMIncomplete
+			}
+			if id == mkvIDVideo {
+				videoEnd := r.pos + size
+				for r.pos < videoEnd {
+					id, size, err := r.readElementHeader()
+					if err != nil || size < 0 {
+						return errWebMIncomplete
+					}
+					b, err := r.readBytes(size)
+					if err != nil {
+						return errWebMIncomplete
+					}
+					switch id {
+					case mkvIDPixelWidth:
+						width = ebmlUint(b)
+					case mkvIDPixelHeight:
+						height = ebmlUint(b)
+					}
+				}
+				continue
+			}
+			b, err := r.readBytes(size)
+			if err != nil {
+				return errWebMIncomplete
+			}
+			switch id {
+			case mkvIDTrackNumber:
+				number = ebmlUint(b)
+			case mkvIDTrackType:
+				trackType = ebmlUint(b)
+			case mkvIDCodecID:
+				codecID = string(bytes.TrimRight(b, "\x00"))
+			}
+		}
+
+		if trackType == mkvTrackTypeVideo && w.videoTrack == 0 {
+			w.videoTrack = number
+			w.codecID = codecID
+			w.width = width
+			w.height = height
+		}
+	}
+	return nil
+}
+
+// scanFrom parses top-level elements from offset to the end of the file,
+// recording the latest video keyframe
+func (w *webmFile) scanFrom(f *os.File, offset int64) error {
+	r := newEBMLReader(f, offset)
+	w.truncated = false
+
+	for r.pos < w.size {
+		start := r.pos
+		id, size, err := r.readElementHeader()
+		if err != nil {
+			w.truncated = true
+			break
+		}
+
+		if id == mkvIDCluster {
+			// Rescan this cluster next time in case it is still growing
+			w.resume = start
+			complete, err := w.scanCluster(r, size)
+			if err != nil {
+				return err
+			}
+			if !complete {
+				w.truncated = true
+				break
+			}
+			continue
+		}
+
+		if size < 0 {
+			return fmt.Errorf("unknown-sized element 0x%X at offset %d", id, start)
+		}
+		if r.pos+size > w.size {
+			w.truncated = true
+			break
+		}
+		if id == mkvIDCues {
+			w.hasCues = true
+		}
+		if err := r.skip(size); err != nil {
+			w.truncated = true
+			break
+		}
+	}
+	return nil
+}
+
+// scanCluster parses the blocks of a cluster. It reports false when the
+// cluster runs past the end of the data written so far.
+func (w *webmFile) scanCluster(r *ebmlReader, size int64) (bool, error) {
+	clusterOffset := r.pos - int64(r.lastHeaderLen)
+	end := int64(math.MaxInt64)
+	if size >= 0 {
+		end = r.pos + size
+	}
+
+	var clusterTime uint64
+	for r.pos < end {
+		if r.pos >= w.size {
+			return size >= 0 && end <= w.size, nil
+		}
+		start := r.pos
+		id, size, err := r.readElementHeader()
+		if err != nil {
+			return false, nil
+		}
+
+		// Clusters of unknown size end at the next top-level element
+		if isTopLevelElement(id) {
+			if err := r.seek(start); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		if size < 0 {
+			return false, fmt.Errorf("unknown-sized element 0x%X in cluster at offset %d", id, start)
+		}
+		if r.pos+size > w.size {
+			return false, nil
+		}
+
+		switch id {
+		case mkvIDClusterTime:
+			b, err := r.readBytes(size)
+			if err != nil {
+				return false, nil
+			}
+			clusterTime = ebmlUint(b)
+		case mkvIDSimpleBlock:
+			if err := w.scanBlock(r, size, clusterOffset, clusterTime, false); err != nil {
+				return false, nil
+			}
+		case mkvIDBlockGroup:
+			if err := w.scanBlockGroup(r, r.pos+size, clusterOffset, clusterTime); err != nil {
+				return false, nil
+			}
+		default:
+			if err := r.skip(size); err != nil {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// scanBlockGroup parses a BlockGroup, which is a keyframe when it carries
+// no ReferenceBlock
+func (w *webmFile) scanBlockGroup(r *ebmlReader, end, clusterOffset int64, clusterTime uint64) error {
+	var blockOffset, blockSize int64 = -1, 0
+	reference := false
+	for r.pos < end {
+		id, size, err := r.readElementHeader()
+		if err != nil || size < 0 {
+			return errWebMIncomplete
+		}
+		switch id {
+		case mkvIDBlock:
+			blockOffset, blockSize = r.pos, size
+		case mkvIDReferenceBlock:
+			reference = true
+		}
+		if err := r.skip(size); err != nil {
+			return err
+		}
+	}
+	if blockOffset < 0 {
+		return nil
+	}
+	if err := r.seek(blockOffset); err != nil {
+		return err
+	}
+	if err := w.scanBlock(r, blockSize, clusterOffset, clusterTime, !reference); err != nil {
+		return err
+	}
+	return r.seek(end)
+}
+
+// scanBlock parses a (Simple)Block header and records it if it is a video
+// keyframe
+func (w *webmFile) scanBlock(r *ebmlReader, size, clusterOffset int64, clusterTime uint64, key bool) error {
+	end := r.pos + size
+	track, n, err := r.readVint(false)
+	if err != nil {
+		return err
+	}
+	hdr, err := r.readBytes(3)
+	if err != nil {
+		return err
+	}
+	relTime := int16(binary.BigEndian.Uint16(hdr[0:2]))
+	flags := hdr[2]
+
+	timestamp := time.Duration((int64(clusterTime) + int64(relTime)) * int64(w.timecodeScale))
+	dataOffset := r.pos
+	dataSize := size - int64(n) - 3
+
+	if track == w.videoTrack && dataSize > 0 {
+		w.lastTime = timestamp
+		// SimpleBlocks carry a keyframe flag; laced video is not expected
+		if (flags&0x80 != 0 || key) && flags&0x06 == 0 {
+			w.lastKeyframe = &webmKeyframe{
+				clusterOffset: clusterOffset,
+				offset:        dataOffset,
+				size:          dataSize,
+				timestamp:     timestamp,
+			}
+		}
+	}
+	return r.seek(end)
+}
+
+// readFrame returns the data of a frame located by the scanner
+func (w *webmFile) readFrame(k *webmKeyframe) ([]byte, error) {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, k.size)
+	if _, err := f.ReadAt(data, k.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// decodeLatestKeyframe decodes the most recent keyframe of a VP8 track
+func (w *webmFile) decodeLatestKeyframe() (image.Image, error) {
+	if w.codecID != "V_VP8" {
+		return nil, fmt.Errorf("codec %s is not supported natively", w.codecID)
+	}
+	if w.lastKeyframe == nil {
+		return nil, fmt.Errorf("no keyframe written yet")
+	}
+	data, err := w.readFrame(w.lastKeyframe)
+	if err != nil {
+		return nil, fmt.Errorf("read keyframe: %w", err)
+	}
+	return decodeVP8Keyframe(data)
+}
+
+// decodeVP8Keyframe decodes a single VP8 keyframe
+func decodeVP8Keyframe(data []byte) (image.Image, error) {
+	d := vp8.NewDecoder()
+	d.Init(bytes.NewReader(data), len(data))
+	fh, err := d.DecodeFrameHeader()
+	if err != nil {
+		return nil, fmt.Errorf("decode VP8 frame header: %w", err)
+	}
+	if !fh.KeyFrame {
+		return nil, fmt.Errorf("VP8 frame is not a keyframe")
+	}
+	img, err := d.DecodeFrame()
+	if err != nil {
+		return nil, fmt.Errorf("decode VP8 frame: %w", err)
+	}
+	return img, nil
+}
+
+// isTopLevelElement reports whether id is a child of the Segment element
+func isTopLevelElement(id uint64) bool {
+	switch id {
+	case mkvIDCluster, mkvIDCues, mkvIDSeekHead, mkvIDInfo, mkvIDTracks,
+		mkvIDChapters, mkvIDTags, mkvIDAttachments:
+		return true
+	}
+	return false
+}
+
+// ebmlUint decodes a big-endian EBML unsigned integer
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// ebmlFloat decodes a 4 or 8 byte EBML float
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// ebmlReader reads EBML elements from a file while tracking the offset
+type ebmlReader struct {
+	f             *os.File
+	r             *bufio.Reader
+	pos           int64
+	lastHeaderLen int
+}
+
+func newEBMLReader(f *os.File, offset int64) *ebmlReader {
+	return &ebmlReader{
+		f:   f,
+		r:   bufio.NewReaderSize(io.NewSectionReader(f, offset, math.MaxInt64-offset), 64*1024),
+		pos: offset,
+	}
+}
+
+// seek moves the reader to an absolute offset
+func (e *ebmlReader) seek(offset int64) error {
+	if offset == e.pos {
+		return nil
+	}
+	if offset > e.pos && offset-e.pos <= int64(e.r.Buffered()) {
+		_, err := e.r.Discard(int(offset - e.pos))
+		e.pos = offset
+		return err
+	}
+	e.r.Reset(io.NewSectionReader(e.f, offset, math.MaxInt64-offset))
+	e.pos = offset
+	return nil
+}
+
+// skip moves the reader forward by n bytes
+func (e *ebmlReader) skip(n int64) error {
+	return e.seek(e.pos + n)
+}
+
+// readBytes reads the next n bytes
+func (e *ebmlReader) readBytes(n int64) ([]byte, error) {
+	if n > 64*1024*1024 {
+		return nil, fmt.Errorf("element too large: %d bytes", n)
+	}
+	b := make([]byte, n)
+	read, err := io.ReadFull(e.r, b)
+	e.pos += int64(read)
+	return b, err
+}
+
+// readVint reads a variable length integer, returning its value and
+// encoded length. Element IDs keep their length marker bit.
+func (e *ebmlReader) readVint(keepMarker bool) (uint64, int, error) {
+	first, err := e.r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	e.pos++
+
+	length := 1
+	for mask := byte(0x80); length <= 8 && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, fmt.Errorf("invalid EBML variable length integer")
+	}
+
+	v := uint64(first)
+	if !keepMarker {
+		v &= uint64(0xFF >> length)
+	}
+	for i := 1; i < length; i++ {
+		c, err := e.r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		e.pos++
+		v = v<<8 | uint64(c)
+	}
+	return v, length, nil
+}
+
+// readElementHeader reads an element ID and size. The size is -1 when the
+// element is marked as having unknown size.
+func (e *ebmlReader) readElementHeader() (uint64, int64, error) {
+	id, idLen, err := e.readVint(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, sizeLen, err := e.readVint(false)
+	if err != nil {
+		return 0, 0, err
+	}
+	e.lastHeaderLen = idLen + sizeLen
+	if size == 1<<(7*uint(sizeLen))-1 {
+		return id, -1, nil
+	}
+	return id, int64(size), nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ebmlUnknownSize marks an element whose size the muxer has not written
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// errAny stands for any error other than errWebMIncomplete in test tables
+var errAny = errors.New("any error")
+
+// ebmlElem encodes an element with an 8 byte size field
+func ebmlElem(id uint64, children ...[]byte) []byte {
+	payload := bytes.Join(children, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(payload)))
+	size[0] = 0x01
+	return bytes.Join([][]byte{ebmlIDBytes(id), size, payload}, nil)
+}
+
+func ebmlIDBytes(id uint64) []byte {
+	var b []byte
+	for ; id > 0; id >>= 8 {
+		b = append([]byte{byte(id)}, b...)
+	}
+	return b
+}
+
+func ebmlUintBytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func ebmlFloatBytes(v float64) []byte {
+	return ebmlUintBytes(math.Float64bits(v))
+}
+
+// ebmlBlock encodes a (Simple)Block payload for a track below 127
+func ebmlBlock(track byte, relTime int16, flags byte, data string) []byte {
+	b := []byte{0x80 | track, byte(uint16(relTime) >> 8), byte(relTime), flags}
+	return append(b, data...)
+}
+
+func testWebMHeader(codec string, trackType uint64) []byte {
+	return bytes.Join([][]byte{
+		ebmlElem(ebmlIDHeader, ebmlElem(ebmlIDDocType, []byte("webm"))),
+		ebmlIDBytes(mkvIDSegment), ebmlUnknownSize,
+		ebmlElem(mkvIDInfo,
+			ebmlElem(mkvIDTimecodeScale, ebmlUintBytes(1000000)),
+			ebmlElem(mkvIDDuration, ebmlFloatBytes(2000)),
+		),
+		ebmlElem(mkvIDTracks, ebmlElem(mkvIDTrackEntry,
+			ebmlElem(mkvIDTrackNumber, ebmlUintBytes(1)),
+			ebmlElem(mkvIDTrackType, ebmlUintBytes(trackType)),
+			ebmlElem(mkvIDCodecID, []byte(codec)),
+			ebmlElem(mkvIDVideo,
+				ebmlElem(mkvIDPixelWidth, ebmlUintBytes(640)),
+				ebmlElem(mkvIDPixelHeight, ebmlUintBytes(480)),
+			),
+		)),
+	}, nil)
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEBMLReadVint(t *testing.T) {
+	tests := []struct {
+		in         []byte
+		keepMarker bool
+		want       uint64
+		wantLen    int
+		wantErr    bool
+	}{
+		{in: []byte{0x81}, want: 1, wantLen: 1},
+		{in: []byte{0x81}, keepMarker: true, want: 0x81, wantLen: 1},
+		{in: []byte{0x40, 0x02}, want: 2, wantLen: 2},
+		{in: []byte{0x1A, 0x45, 0xDF, 0xA3}, keepMarker: true, want: ebmlIDHeader, wantLen: 4},
+		{in: []byte{0x01, 0, 0, 0, 0, 0, 0x01, 0x00}, want: 256, wantLen: 8},
+		{in: []byte{0x00}, wantErr: true},
+		{in: []byte{0x40}, wantErr: true},
+		{in: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(writeTestFile(t, "vint", tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, n, err := newEBMLReader(f, 0).readVint(tt.keepMarker)
+		f.Close()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("readVint(% X) = %d, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || n != tt.wantLen {
+			t.Errorf("readVint(% X) = %d, %d, %v, want %d, %d", tt.in, got, n, err, tt.want, tt.wantLen)
+		}
+	}
+}
+
+func TestEBMLReadElementHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		wantID   uint64
+		wantSize int64
+	}{
+		{name: "short size", in: []byte{0xE7, 0x81}, wantID: mkvIDClusterTime, wantSize: 1},
+		{name: "long size", in: ebmlElem(mkvIDTracks, make([]byte, 300))[:12], wantID: mkvIDTracks, wantSize: 300},
+		{name: "unknown size", in: append(ebmlIDBytes(mkvIDCluster), ebmlUnknownSize...), wantID: mkvIDCluster, wantSize: -1},
+		{name: "unknown short size", in: []byte{0x18, 0x53, 0x80, 0x67, 0xFF}, wantID: mkvIDSegment, wantSize: -1},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(writeTestFile(t, "element", tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := newEBMLReader(f, 0)
+		id, size, err := r.readElementHeader()
+		f.Close()
+		if err != nil || id != tt.wantID || size != tt.wantSize {
+			t.Errorf("%s: got 0x%X, %d, %v, want 0x%X, %d", tt.name, id, size, err, tt.wantID, tt.wantSize)
+		}
+		if r.pos != int64(len(tt.in)) {
+			t.Errorf("%s: reader at %d, want %d", tt.name, r.pos, len(tt.in))
+		}
+	}
+}
+
+func TestOpenWebM(t *testing.T) {
+	header := testWebMHeader("V_VP8", mkvTrackTypeVideo)
+	clusters := bytes.Join([][]byte{
+		ebmlElem(mkvIDCluster,
+			ebmlElem(mkvIDClusterTime, ebmlUintBytes(0)),
+			ebmlElem(mkvIDSimpleBlock, ebmlBlock(1, 0, 0x80, "key0")),
+			ebmlElem(mkvIDSimpleBlock, ebmlBlock(1, 40, 0x00, "delta")),
+		),
+		ebmlElem(mkvIDCluster,
+			ebmlElem(mkvIDClusterTime, ebmlUintBytes(1000)),
+			ebmlElem(mkvIDSimpleBlock, ebmlBlock(1, 0, 0x00, "delta")),
+			ebmlElem(mkvIDSimpleBlock, ebmlBlock(1, 80, 0x80, "key1")),
+			ebmlElem(mkvIDSimpleBlock, ebmlBlock(2, 90, 0x80, "audio")),
+		),
+	}, nil)
+	blockGroups := ebmlElem(mkvIDCluster,
+		ebmlElem(mkvIDClusterTime, ebmlUintBytes(2000)),
+		ebmlElem(mkvIDBlockGroup, ebmlElem(mkvIDBlock, ebmlBlock(1, 0, 0, "group"))),
+		ebmlElem(mkvIDBlockGroup,
+			ebmlElem(mkvIDBlock, ebmlBlock(1, 40, 0, "ref")),
+			ebmlElem(mkvIDReferenceBlock, []byte{0xD8}),
+		),
+	)
+	unsized := bytes.Join([][]byte{
+		ebmlIDBytes(mkvIDCluster), ebmlUnknownSize,
+		ebmlElem(mkvIDClusterTime, ebmlUintBytes(3000)),
+		ebmlElem(mkvIDSimpleBlock, ebmlBlock(1, 0, 0x80, "open")),
+		ebmlElem(mkvIDCues),
+	}, nil)
+
+	tests := []struct {
+		name          string
+		data          []byte
+		wantErr       error // errWebMIncomplete, or errAny for any other error
+		wantCodec     string
+		wantKey       string
+		wantTime      time.Duration
+		wantTruncated bool
+		wantCues      bool
+	}{
+		{name: "simple blocks", data: append(header, clusters...), wantCodec: "V_VP8", wantKey: "key1", wantTime: 1080 * time.Millisecond},
+		{name: "block groups", data: bytes.Join([][]byte{header, clusters, blockGroups}, nil), wantCodec: "V_VP8", wantKey: "group", wantTime: 2 * time.Second},
+		{name: "unknown-sized cluster", data: append(header, unsized...), wantCodec: "V_VP8", wantKey: "open", wantTime: 3 * time.Second, wantCues: true},
+		{name: "cluster cut off", data: append(header, clusters[:len(clusters)-20]...), wantCodec: "V_VP8", wantKey: "key0", wantTruncated: true},
+		{name: "vp9", data: append(testWebMHeader("V_VP9", mkvTrackTypeVideo), clusters...), wantCodec: "V_VP9", wantKey: "key1", wantTime: 1080 * time.Millisecond},
+		{name: "no cluster yet", data: header, wantErr: errWebMIncomplete},
+		{name: "header cut off", data: header[:10], wantErr: errWebMIncomplete},
+		{name: "empty", data: nil, wantErr: errWebMIncomplete},
+		{name: "no video track", data: append(testWebMHeader("A_OPUS", 2), clusters...), wantErr: errAny},
+		{name: "not ebml", data: []byte("RIFF....WEBPVP8 "), wantErr: errAny},
+	}
+	for _, tt := range tests {
+		w, err := openWebM(writeTestFile(t, "segment.webm", tt.data))
+		if tt.wantErr != nil {
+			if err == nil || (tt.wantErr != errAny && !errors.Is(err, tt.wantErr)) || (tt.wantErr == errAny && errors.Is(err, errWebMIncomplete)) {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if w.codecID != tt.wantCodec || w.width != 640 || w.height != 480 || w.duration != 2*time.Second {
+			t.Errorf("%s: got %s %dx%d %s", tt.name, w.codecID, w.width, w.height, w.duration)
+		}
+		if w.truncated != tt.wantTruncated || w.hasCues != tt.wantCues {
+			t.Errorf("%s: truncated %v cues %v, want %v %v", tt.name, w.truncated, w.hasCues, tt.wantTruncated, tt.wantCues)
+		}
+		if w.lastKeyframe == nil {
+			t.Errorf("%s: no keyframe found", tt.name)
+			continue
+		}
+		data, err := w.readFrame(w.lastKeyframe)
+		if err != nil || string(data) != tt.wantKey || w.lastKeyframe.timestamp != tt.wantTime {
+			t.Errorf("%s: keyframe %q at %s (%v), want %q at %s", tt.name, data, w.lastKeyframe.timestamp, err, tt.wantKey, tt.wantTime)
+		}
+	}
+}
+
+func TestWebMScanAppended(t *testing.T) {
+	first := ebmlElem(mkvIDCluster,
+		ebmlElem(mkvIDClusterTime, ebmlUintBytes(0)),
+		ebmlElem(mkvIDSimpleBlock, ebmlBlock(1, 0, 0x80, "key0")),
+	)
+	second := ebmlElem(mkvIDCluster,
+		ebmlElem(mkvIDClusterTime, ebmlUintBytes(5000)),
+		ebmlElem(mkvIDSimpleBlock, ebmlBlock(1, 0, 0x80, "key5")),
+	)
+	path := writeTestFile(t, "segment.webm", append(testWebMHeader("V_VP8", mkvTrackTypeVideo), first...))
+
+	w, err := openWebM(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.lastKeyframe == nil || w.lastKeyframe.timestamp != 0 {
+		t.Fatalf("first keyframe not found: %+v", w.lastKeyframe)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(second)
+	f.Close()
+
+	if err := w.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := w.readFrame(w.lastKeyframe); err != nil || string(data) != "key5" {
+		t.Errorf("after append got %q (%v), want key5", data, err)
+	}
+}
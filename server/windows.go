@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+)
+
+// errWindowNotFound is returned when no visible window matches a title
+var errWindowNotFound = errors.New("no visible window found")
+
+// windowLocator finds application windows on the desktop
+type windowLocator interface {
+	// FindWindow returns the desktop rectangle of the first visible window
+	// whose title contains the given text, ignoring case
+	FindWindow(title string) (image.Rectangle, error)
+
+	// FindWindows returns the desktop rectangles of every visible window
+	// whose title contains the given text, ignoring case
+	FindWindows(title string) ([]image.Rectangle, error)
+
+	// ActiveWindow returns the title of the focused window
+	ActiveWindow() (string, error)
+}
+
+// x11WindowLocator finds windows through the EWMH client list of the X
+// server (including Xwayland clients on Wayland sessions)
+type x11WindowLocator struct {
+	mu    sync.Mutex
+	conn  *xgb.Conn
+	root  xproto.Window
+	atoms map[string]xproto.Atom
+}
+
+// waylandSession reports whether the desktop is a Wayland session, where
+// native Wayland windows are not in the X server's client list
+func waylandSession() bool {
+	return os.Getenv("WAYLAND_DISPLAY") != "" || os.Getenv("XDG_SESSION_TYPE") == "wayland"
+}
+
+// newX11WindowLocator connects to $DISPLAY, if one is set
+func newX11WindowLocator() (*x11WindowLocator, error) {
+	if os.Getenv("DISPLAY") == "" {
+		return nil, fmt.Errorf("DISPLAY is not set")
+	}
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, fmt.Errorf("connect to X server: %w", err)
+	}
+
+	x := &x11WindowLocator{
+		conn:  conn,
+		root:  xproto.Setup(conn).DefaultScreen(conn).Root,
+		atoms: make(map[string]xproto.Atom),
+	}
+	for _, name := range []string{"_NET_ACTIVE_WINDOW", "_NET_CLIENT_LIST", "_NET_WM_NAME", "UTF8_STRING"} {
+		reply, err := xproto.InternAtom(conn, false, uint16(len(name)), name).Reply()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("intern atom %s: %w", name, err)
+		}
+		x.atoms[name] = reply.Atom
+	}
+	return x, nil
+}
+
+// FindWindow searches the client list for a matching, mapped window
+func (x *x11WindowLocator) FindWindow(title string) (image.Rectangle, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	wins, err := x.matching(title, true)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	if len(wins) == 0 {
+		return image.Rectangle{}, fmt.Errorf("%w matching %q", errWindowNotFound, title)
+	}
+	return wins[0], nil
+}
+
+// FindWindows searches the client list for every matching, mapped window
+func (x *x11WindowLocator) FindWindows(title string) ([]image.Rectangle, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.matching(title, false)
+}
+
+// matching returns the rectangles of the mapped clients whose title
+// contains the given text, stopping at the first when first is set. The
+// caller must hold x.mu.
+func (x *x11WindowLocator) matching(title string, first bool) ([]image.Rectangle, error) {
+	clients, err := x.clientList()
+	if err != nil {
+		return nil, err
+	}
+
+	var rects []image.Rectangle
+	want := strings.ToLower(title)
+	for _, win := range clients {
+		if !strings.Contains(strings.ToLower(x.windowTitle(win)), want) {
+			continue
+		}
+		attrs, err := xproto.GetWindowAttributes(x.conn, win).Reply()
+		if err != nil || attrs.MapState != xproto.MapStateViewable {
+			continue
+		}
+		r, err := x.windowRect(win)
+		if err != nil {
+			return nil, err
+		}
+		rects = append(rects, r)
+		if first {
+			break
+		}
+	}
+	return rects, nil
+}
+
+// ActiveWindow reads the title of the window named by _NET_ACTIVE_WINDOW
+func (x *x11WindowLocator) ActiveWindow() (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	reply, err := xproto.GetProperty(x.conn, false, x.root, x.atoms["_NET_ACTIVE_WINDOW"],
+		xproto.AtomWindow, 0, 1).Reply()
+	if err != nil {
+		return "", fmt.Errorf("read active window: %w", err)
+	}
+	if len(reply.Value) < 4 {
+		return "", nil
+	}
+	win := xproto.Window(xgb.Get32(reply.Value))
+	if win == 0 {
+		return "", nil
+	}
+	return x.windowTitle(win), nil
+}
+
+// clientList returns the managed top-level windows
+func (x *x11WindowLocator) clientList() ([]xproto.Window, error) {
+	reply, err := xproto.GetProperty(x.conn, false, x.root, x.atoms["_NET_CLIENT_LIST"],
+		xproto.AtomWindow, 0, 1<<16).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("read client list: %w", err)
+	}
+	windows := make([]xproto.Window, 0, reply.ValueLen)
+	for i := 0; i+4 <= len(reply.Value); i += 4 {
+		windows = append(windows, xproto.Window(xgb.Get32(reply.Value[i:])))
+	}
+	return windows, nil
+}
+
+// windowTitle returns _NET_WM_NAME, falling back to WM_NAME
+func (x *x11WindowLocator) windowTitle(win xproto.Window) string {
+	reply, err := xproto.GetProperty(x.conn, false, win, x.atoms["_NET_WM_NAME"],
+		x.atoms["UTF8_STRING"], 0, 1<<10).Reply()
+	if err == nil && len(reply.Value) > 0 {
+		return string(reply.Value)
+	}
+	reply, err = xproto.GetProperty(x.conn, false, win, xproto.AtomWmName,
+		xproto.AtomString, 0, 1<<10).Reply()
+	if err == nil {
+		return string(reply.Value)
+	}
+	return ""
+}
+
+// windowRect returns a window's rectangle in root window coordinates
+func (x *x11WindowLocator) windowRect(win xproto.Window) (image.Rectangle, error) {
+	geom, err := xproto.GetGeometry(x.conn, xproto.Drawable(win)).Reply()
+	if err != nil {
+		return image.Rectangle{}, fmt.Errorf("get window geometry: %w", err)
+	}
+	pos, err := xproto.TranslateCoordinates(x.conn, win, x.root, 0, 0).Reply()
+	if err != nil {
+		return image.Rectangle{}, fmt.Errorf("translate window coordinates: %w", err)
+	}
+	return image.Rect(int(pos.DstX), int(pos.DstY),
+		int(pos.DstX)+int(geom.Width), int(pos.DstY)+int(geom.Height)), nil
+}